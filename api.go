@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultPageLimit is the number of items returned when no limit is requested
+	defaultPageLimit = 100
+	// maxPageLimit is the upper bound for the number of items in a single page
+	maxPageLimit = 1000
+)
+
+// page is the paginated response returned by the snapshot browsing API
+type page struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+// setupAPI sets up the read-only endpoints for browsing snapshots
+func (b *backup) setupAPI(mux *http.ServeMux) {
+	cfg := b.conf()
+	if cfg.APIEndpoint == "" {
+		logger.Info("snapshot API disabled")
+		return
+	}
+	prefix := strings.TrimSuffix(cfg.APIEndpoint, "/")
+	creds := cfg.triggerCredentials()
+	if !creds.enabled() && !creds.clientCert {
+		logger.Warn("snapshot API is served without authentication, file names of all snapshots are exposed")
+	}
+	mux.Handle(prefix+"/snapshots", requireAuth(creds, apiHandler(b.handleSnapshots)))
+	mux.Handle(prefix+"/ls", requireAuth(creds, apiHandler(b.handleLs)))
+	mux.Handle(prefix+"/find", requireAuth(creds, apiHandler(b.handleFind)))
+	logger.Info("snapshot API configured: " + prefix)
+}
+
+// apiHandler restricts a handler to GET requests and renders its result or error as JSON
+func apiHandler(fn func(r *http.Request) (*page, int, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		res, status, err := fn(r)
+		if err != nil {
+			logger.Warn("snapshot API request failed",
+				zap.String("path", r.URL.Path),
+				zap.Error(err))
+			writeJSON(w, status, map[string]string{"error": secrets.redact(err.Error())})
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+}
+
+// handleSnapshots lists the snapshots in the repository, newest first
+func (b *backup) handleSnapshots(r *http.Request) (*page, int, error) {
+	var args []string
+	q := r.URL.Query()
+	for _, host := range q["host"] {
+		args = append(args, "--host", host)
+	}
+	for _, tag := range q["tag"] {
+		args = append(args, "--tag", tag)
+	}
+	for _, path := range q["path"] {
+		args = append(args, "--path", path)
+	}
+	snapshots, err := b.runner().snapshots(r.Context(), args...)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	// restic lists the oldest snapshot first
+	for i, j := 0, len(snapshots)-1; i < j; i, j = i+1, j-1 {
+		snapshots[i], snapshots[j] = snapshots[j], snapshots[i]
+	}
+	return paginate(r, snapshots)
+}
+
+// handleLs lists the files of a snapshot, optionally restricted to a directory
+func (b *backup) handleLs(r *http.Request) (*page, int, error) {
+	q := r.URL.Query()
+	id := q.Get("snapshot")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.New("missing snapshot")
+	}
+	if strings.HasPrefix(id, "-") {
+		return nil, http.StatusBadRequest, errors.New("invalid snapshot")
+	}
+	args := []string{"--", id}
+	if path := q.Get("path"); path != "" {
+		args = append(args, path)
+	}
+	nodes, err := b.runner().ls(r.Context(), args...)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return paginate(r, nodes)
+}
+
+// handleFind searches all snapshots (or a single one) for files matching a pattern
+func (b *backup) handleFind(r *http.Request) (*page, int, error) {
+	q := r.URL.Query()
+	pattern := q.Get("pattern")
+	if pattern == "" {
+		return nil, http.StatusBadRequest, errors.New("missing pattern")
+	}
+	var args []string
+	if id := q.Get("snapshot"); id != "" {
+		args = append(args, "--snapshot", id)
+	}
+	args = append(args, "--", pattern)
+	results, err := b.runner().find(r.Context(), args...)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return paginate(r, results)
+}
+
+// parseLsOutput extracts the file nodes from the line-based output of `restic ls --json`
+func parseLsOutput(out []byte) ([]LsNode, error) {
+	nodes := []LsNode{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var node LsNode
+		if err := json.Unmarshal(line, &node); err != nil {
+			return nil, errors.Wrap(err, "parsing ls output")
+		}
+		// the first line describes the snapshot itself
+		if node.StructType == "snapshot" || node.MessageType == "snapshot" {
+			continue
+		}
+		node.StructType = ""
+		node.MessageType = ""
+		nodes = append(nodes, node)
+	}
+	return nodes, scanner.Err()
+}
+
+// paginate returns the slice of items selected by the offset and limit query parameters
+func paginate[T any](r *http.Request, items []T) (*page, int, error) {
+	offset, limit := 0, defaultPageLimit
+	q := r.URL.Query()
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, http.StatusBadRequest, errors.New("invalid offset")
+		}
+		offset = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return nil, http.StatusBadRequest, errors.Errorf("invalid limit, must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+	start := min(offset, len(items))
+	end := min(start+limit, len(items))
+	return &page{
+		Items:  items[start:end],
+		Total:  len(items),
+		Offset: offset,
+		Limit:  limit,
+	}, http.StatusOK, nil
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("failed to write response", zap.Error(err))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseLsOutput(t *testing.T) {
+	input := `{"time":"2024-03-01T02:00:00Z","paths":["/data"],"hostname":"host","id":"5f3a","short_id":"5f3a","struct_type":"snapshot"}
+{"name":"data","type":"dir","path":"/data","mtime":"2024-03-01T01:00:00Z","struct_type":"node"}
+{"name":"config.yml","type":"file","path":"/data/config.yml","size":42,"mtime":"2024-03-01T01:00:00Z","struct_type":"node"}
+`
+	nodes, err := parseLsOutput([]byte(input))
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	assert.Equal(t, "/data/config.yml", nodes[1].Path)
+	assert.Equal(t, uint64(42), nodes[1].Size)
+	assert.Empty(t, nodes[1].StructType)
+}
+
+func Test_paginate(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4}
+	tests := []struct {
+		query      string
+		wantItems  []int
+		wantStatus int
+	}{
+		{"", []int{0, 1, 2, 3, 4}, http.StatusOK},
+		{"?limit=2", []int{0, 1}, http.StatusOK},
+		{"?offset=3&limit=5", []int{3, 4}, http.StatusOK},
+		{"?offset=10", []int{}, http.StatusOK},
+		{"?offset=-1", nil, http.StatusBadRequest},
+		{"?limit=0", nil, http.StatusBadRequest},
+		{"?limit=100000", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/snapshots"+tt.query, nil)
+			res, status, err := paginate(r, items)
+			assert.Equal(t, tt.wantStatus, status)
+			if tt.wantStatus != http.StatusOK {
+				assert.Error(t, err)
+				return
+			}
+			assert.Equal(t, tt.wantItems, res.Items)
+			assert.Equal(t, len(items), res.Total)
+		})
+	}
+}
+
+func Test_snapshotAPI(t *testing.T) {
+	fake := &fakeRunner{script: map[string]fakeResult{
+		"snapshots": {output: []byte(`[{"id":"old","time":"2024-03-01T02:00:00Z"},{"id":"new","time":"2024-03-02T02:00:00Z"}]`)},
+		"ls":        {output: []byte(`{"name":"config.yml","type":"file","path":"/data/config.yml","struct_type":"node"}` + "\n")},
+		"find":      {err: errors.New("no matching snapshots")},
+	}}
+	b := newTestBackup()
+	b.restic = fake
+	b.conf().APIEndpoint = "/api"
+	mux := http.NewServeMux()
+	b.setupAPI(mux)
+
+	get := func(target string) (int, map[string]json.RawMessage) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var body map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	code, body := get("/api/snapshots?tag=daily")
+	assert.Equal(t, http.StatusOK, code)
+	var snapshots []Snapshot
+	require.NoError(t, json.Unmarshal(body["items"], &snapshots))
+	require.Len(t, snapshots, 2)
+	// newest first
+	assert.Equal(t, "new", snapshots[0].ID)
+
+	code, body = get("/api/ls?snapshot=new&path=/data")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1", string(body["total"]))
+
+	code, body = get("/api/find?pattern=*.yml")
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Contains(t, string(body["error"]), "no matching snapshots")
+
+	assert.Equal(t, []string{
+		"snapshots --tag daily",
+		"ls -- new /data",
+		"find -- *.yml",
+	}, fake.calls)
+}
@@ -1,9 +1,20 @@
 package main
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 // parseArg parses restic arguments and splits them by spaces or quoted parts
 func parseArg(arg string) []string {
+	res, _ := splitArg(arg)
+	return res
+}
+
+// splitArg splits arguments like parseArg, but also reports input that parseArg
+// silently accepts although it was most likely not meant that way
+func splitArg(arg string) ([]string, error) {
 	// res is the assembled result
 	var res []string
 	// sb is assembling the current argument
@@ -61,5 +72,11 @@ func parseArg(arg string) []string {
 	if sb.Len() > 0 {
 		res = append(res, sb.String())
 	}
-	return res
+	if isQuoted {
+		return res, errors.New("unterminated quote")
+	}
+	if isEscaped {
+		return res, errors.New("trailing backslash")
+	}
+	return res, nil
 }
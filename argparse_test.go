@@ -21,3 +21,18 @@ func TestParseArg(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitArgErrors(t *testing.T) {
+	var tests = map[string]bool{
+		"foo \"bar baz\"": false,
+		"foo \"bar baz":   true,
+		"foo bar\\":       true,
+		"foo bar\\\\":     false,
+	}
+	for input, wantErr := range tests {
+		_, err := splitArg(input)
+		if (err != nil) != wantErr {
+			t.Errorf("error for input '%s' was %v, expected error: %v", input, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// credentials holds the optional bearer token and basic auth pair protecting endpoints
+type credentials struct {
+	token    string
+	username string
+	password string
+	// clientCert requires a verified client certificate in addition
+	clientCert bool
+}
+
+// triggerCredentials returns the credentials protecting the trigger and API endpoints
+func (c *config) triggerCredentials() credentials {
+	return credentials{
+		token:      c.TriggerToken,
+		username:   c.TriggerUsername,
+		password:   c.TriggerPassword,
+		clientCert: c.TLSClientCAFile != "",
+	}
+}
+
+// metricsCredentials returns the credentials protecting the metrics endpoint
+func (c *config) metricsCredentials() credentials {
+	return credentials{
+		token:      c.MetricsToken,
+		username:   c.MetricsUsername,
+		password:   c.MetricsPassword,
+		clientCert: c.TLSClientCAFile != "",
+	}
+}
+
+// basic returns true if HTTP basic auth is configured
+func (c credentials) basic() bool {
+	return c.username != "" || c.password != ""
+}
+
+// enabled returns true if a token or basic auth is configured
+func (c credentials) enabled() bool {
+	return c.token != "" || c.basic()
+}
+
+// verifiedClient returns true if the client presented a certificate signed by TLS_CLIENT_CA_FILE.
+// The TLS handshake only verifies certificates which are given, so that health probes
+// can connect without one.
+func verifiedClient(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// authorized checks the request against the configured token and basic auth pair,
+// accepting either of them if both are configured
+func (c credentials) authorized(r *http.Request) bool {
+	if c.token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureCompare(token, c.token) {
+			return true
+		}
+	}
+	if c.basic() {
+		if username, password, ok := r.BasicAuth(); ok {
+			// evaluate both to avoid leaking which one was wrong through timing
+			validUser := secureCompare(username, c.username)
+			validPassword := secureCompare(password, c.password)
+			if validUser && validPassword {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireAuth wraps a handler to reject requests without valid credentials
+func requireAuth(c credentials, next http.Handler) http.Handler {
+	if !c.enabled() && !c.clientCert {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.clientCert && !verifiedClient(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if c.enabled() && !c.authorized(r) {
+			if c.basic() {
+				w.Header().Set("WWW-Authenticate", `Basic realm="restic-robot"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="restic-robot"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// secureCompare compares two strings in constant time
+func secureCompare(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_requireAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		name       string
+		creds      credentials
+		prepare    func(r *http.Request)
+		wantStatus int
+	}{
+		{"disabled", credentials{}, func(r *http.Request) {}, http.StatusNoContent},
+		{"missing token", credentials{token: "secret"}, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong token", credentials{token: "secret"}, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer nope")
+		}, http.StatusUnauthorized},
+		{"valid token", credentials{token: "secret"}, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer secret")
+		}, http.StatusNoContent},
+		{"wrong password", credentials{username: "robot", password: "secret"}, func(r *http.Request) {
+			r.SetBasicAuth("robot", "nope")
+		}, http.StatusUnauthorized},
+		{"valid basic", credentials{username: "robot", password: "secret"}, func(r *http.Request) {
+			r.SetBasicAuth("robot", "secret")
+		}, http.StatusNoContent},
+		{"basic when both configured", credentials{token: "token", username: "robot", password: "secret"}, func(r *http.Request) {
+			r.SetBasicAuth("robot", "secret")
+		}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/trigger", nil)
+			tt.prepare(r)
+			w := httptest.NewRecorder()
+			requireAuth(tt.creds, ok).ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus == http.StatusUnauthorized {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// triggerCatchUp marks runs started because a scheduled run was missed
+const triggerCatchUp = "catch-up"
+
+// state is persisted between restarts in STATE_FILE
+type state struct {
+	LastRun     time.Time `json:"last_run"`
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// loadState reads the state file, returning an empty state if it does not exist yet
+func loadState(path string) (state, error) {
+	var s state
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, errors.Wrap(err, "reading state file")
+	}
+	if err := json.Unmarshal(content, &s); err != nil {
+		return s, errors.Wrap(err, "parsing state file")
+	}
+	return s, nil
+}
+
+// saveState writes the state file atomically
+func saveState(path string, s state) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "creating state file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing state file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing state file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "replacing state file")
+}
+
+// recordRun persists the start time of a completed run, and its end if it succeeded
+func (b *backup) recordRun(r *run) {
+	path := b.conf().StateFile
+	result := r.Result()
+	if path == "" || result.Job != "" {
+		// discovered jobs have their own schedules
+		return
+	}
+	s, err := loadState(path)
+	if err != nil {
+		logger.Warn("failed to load state, replacing it", zap.Error(err))
+	}
+	s.LastRun = result.Started
+	if result.Status == runStatusSucceeded && result.Finished != nil {
+		s.LastSuccess = *result.Finished
+	}
+	if err := saveState(path, s); err != nil {
+		logger.Warn("failed to save state", zap.Error(err))
+	}
+}
+
+// lastRun returns the time of the last backup from the state file, falling back to
+// the time of the latest snapshot of this host
+func (b *backup) lastRun(cfg *config) (time.Time, error) {
+	if cfg.StateFile != "" {
+		s, err := loadState(cfg.StateFile)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !s.LastRun.IsZero() {
+			return s.LastRun, nil
+		}
+	}
+	return b.latestSnapshot()
+}
+
+// lastSuccess returns the time of the last successful backup from the state file, falling
+// back to the time of the latest snapshot of this host
+func (b *backup) lastSuccess(cfg *config) (time.Time, error) {
+	if cfg.StateFile != "" {
+		s, err := loadState(cfg.StateFile)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !s.LastSuccess.IsZero() {
+			return s.LastSuccess, nil
+		}
+	}
+	return b.latestSnapshot()
+}
+
+// latestSnapshot returns the time of the latest snapshot of this host, or zero if there is none
+func (b *backup) latestSnapshot() (time.Time, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return time.Time{}, err
+	}
+	snapshots, err := b.runner().snapshots(context.Background(), "--latest", "1", "--host", host)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var latest time.Time
+	for _, snapshot := range snapshots {
+		if snapshot.Time.After(latest) {
+			latest = snapshot.Time
+		}
+	}
+	return latest, nil
+}
+
+// missedRun returns the most recent scheduled time after the last run which lies within
+// the window before now, if there is one
+func missedRun(schedule cron.Schedule, last, now time.Time, window time.Duration) (time.Time, bool) {
+	from := last
+	if earliest := now.Add(-window); from.Before(earliest) {
+		from = earliest
+	}
+	var missed time.Time
+	for next := schedule.Next(from); !next.After(now); next = schedule.Next(next) {
+		missed = next
+	}
+	return missed, !missed.IsZero()
+}
+
+// catchUp runs a single backup if scheduled runs were missed while the daemon was down
+func (b *backup) catchUp() {
+	cfg := b.conf()
+	if cfg.CatchUpWindow <= 0 {
+		return
+	}
+	schedule, err := cfg.parseSchedule()
+	if err != nil {
+		logger.Error("failed to parse schedule", zap.Error(err))
+		return
+	}
+	last, err := b.lastRun(cfg)
+	if err != nil {
+		logger.Warn("failed to determine last backup, skipping catch-up", zap.Error(err))
+		return
+	}
+	missed, ok := missedRun(schedule, last, time.Now(), cfg.CatchUpWindow)
+	if !ok {
+		logger.Debug("no missed backups", zap.Time("last", last))
+		return
+	}
+	logger.Info("scheduled backup was missed, catching up",
+		zap.Time("missed", missed),
+		zap.Time("last", last))
+	b.runNow(triggerCatchUp)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_missedRun(t *testing.T) {
+	schedule, err := (&config{Schedule: "0 2 * * *"}).parseSchedule()
+	require.NoError(t, err)
+	day := func(d, h int) time.Time {
+		return time.Date(2024, 3, d, h, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name       string
+		last       time.Time
+		now        time.Time
+		window     time.Duration
+		wantMissed time.Time
+		wantOK     bool
+	}{
+		{"ran as scheduled", day(5, 2), day(5, 9), 48 * time.Hour, time.Time{}, false},
+		{"missed this night", day(4, 2), day(5, 9), 48 * time.Hour, day(5, 2), true},
+		{"missed several nights", day(1, 2), day(5, 9), 72 * time.Hour, day(5, 2), true},
+		{"missed outside of the window", day(4, 2), day(5, 9), 6 * time.Hour, time.Time{}, false},
+		{"never ran", time.Time{}, day(5, 9), 12 * time.Hour, day(5, 2), true},
+		{"before the next run", day(5, 2), day(6, 1), 48 * time.Hour, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missed, ok := missedRun(schedule, tt.last, tt.now, tt.window)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.True(t, tt.wantMissed.Equal(missed), "got %v", missed)
+		})
+	}
+}
+
+func Test_state(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := loadState(path)
+	require.NoError(t, err)
+	assert.True(t, s.LastRun.IsZero())
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, saveState(path, state{LastRun: now}))
+	s, err = loadState(path)
+	require.NoError(t, err)
+	assert.True(t, now.Equal(s.LastRun))
+}
+
+func Test_recordRun(t *testing.T) {
+	b := newTestBackup()
+	b.conf().StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	succeeded := newRun(triggerSchedule, runOptions{})
+	succeeded.finish(nil, nil)
+	b.recordRun(succeeded)
+	s, err := loadState(b.conf().StateFile)
+	require.NoError(t, err)
+	assert.True(t, succeeded.Result().Started.Equal(s.LastRun))
+	assert.True(t, succeeded.Result().Finished.Equal(s.LastSuccess))
+
+	// a failed run keeps the last success
+	failed := newRun(triggerSchedule, runOptions{})
+	failed.finish(assert.AnError, nil)
+	b.recordRun(failed)
+	s, err = loadState(b.conf().StateFile)
+	require.NoError(t, err)
+	assert.True(t, failed.Result().Started.Equal(s.LastRun))
+	assert.True(t, succeeded.Result().Finished.Equal(s.LastSuccess))
+
+	last, err := b.lastSuccess(b.conf())
+	require.NoError(t, err)
+	assert.True(t, succeeded.Result().Finished.Equal(last))
+}
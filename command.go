@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
 func executeCommand(command string) (*string, error) {
@@ -19,14 +20,17 @@ func executeCommand(command string) (*string, error) {
 	return &stdout, nil
 }
 
-func (b *backup) executePreCommand() (*string, error) {
-	return executeCommand(b.PreCommand)
-}
-
-func (b *backup) executePostCommand() (*string, error) {
-	return executeCommand(b.PostCommand)
-}
-
-func (b *backup) executeErrorCommand() (*string, error) {
-	return executeCommand(b.ErrorCommand)
+// runHook executes a hook command if it is configured and logs its output
+func runHook(name, command string) error {
+	if command == "" {
+		return nil
+	}
+	logger.Debug("executing "+name, zap.String("command", command))
+	stdout, err := executeCommand(command)
+	if err != nil {
+		logger.Error("failed to execute " + name + ": " + err.Error())
+		return err
+	}
+	logger.Info("output of " + name + ": " + *stdout)
+	return nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// config holds all settings read from the environment
+type config struct {
+	Schedule            string           `required:"true"    envconfig:"SCHEDULE"`                  // cron schedule
+	CronTZ              string           `                   envconfig:"CRON_TZ"`                   // time zone of the cron schedule, defaults to TZ or the local time zone
+	ScheduleJitter      time.Duration    `                   envconfig:"SCHEDULE_JITTER"`           // maximum random delay of scheduled backups
+	Repository          string           `required:"true"    envconfig:"RESTIC_REPOSITORY"`         // repository name
+	Password            string           `required:"true"    envconfig:"RESTIC_PASSWORD"`           // repository password, or RESTIC_PASSWORD_FILE / RESTIC_PASSWORD_COMMAND
+	ResticBinary        string           `default:"restic"   envconfig:"RESTIC_BINARY"`             // restic executable, looked up in PATH unless it is a path
+	Secondaries         repositoryList   `                   envconfig:"SECONDARY_REPOSITORIES"`    // semicolon-separated name=repository pairs to copy or back up to as well
+	SecondaryMode       string           `default:"copy"     envconfig:"SECONDARY_MODE"`            // copy new snapshots from the primary repository, or backup to each repository
+	SecondaryPassword   string           `                   envconfig:"SECONDARY_PASSWORD"`        // password of the secondary repositories, defaults to RESTIC_PASSWORD
+	Args                string           `                   envconfig:"RESTIC_ARGS"`               // additional args for backup command
+	LimitUpload         int              `                   envconfig:"LIMIT_UPLOAD"`              // upload limit of backups in KiB/s
+	LimitDownload       int              `                   envconfig:"LIMIT_DOWNLOAD"`            // download limit of backups in KiB/s
+	Nice                int              `                   envconfig:"NICE"`                      // niceness added to the restic process
+	IONice              ioPriority       `                   envconfig:"IONICE"`                    // IO class of the restic process: idle, best-effort[:level] or realtime[:level]
+	ThrottleProfiles    throttleProfiles `                   envconfig:"THROTTLE_PROFILES"`         // semicolon-separated time-of-day overrides, e.g. "Mon-Fri 08:00-20:00 upload=1024 nice=10"
+	SourceType          string           `                   envconfig:"SOURCE_TYPE"`               // back up a database dump streamed from postgres, mysql or sqlite instead of files
+	SourceDatabase      string           `                   envconfig:"SOURCE_DATABASE"`           // database name, or database file for sqlite
+	SourceArgs          string           `                   envconfig:"SOURCE_ARGS"`               // additional args for the dump command
+	SourceCommand       string           `                   envconfig:"SOURCE_COMMAND"`            // command whose output is backed up with SOURCE_TYPE=command
+	SourceTimeout       time.Duration    `                   envconfig:"SOURCE_TIMEOUT"`            // maximum duration of a backup from a source, 0 for no limit
+	SourceFilename      string           `                   envconfig:"SOURCE_FILENAME"`           // file name of the dump in the snapshot, defaults to <database>.sql
+	SnapshotProvider    string           `                   envconfig:"SNAPSHOT_PROVIDER"`         // back up a btrfs, zfs or lvm snapshot of SNAPSHOT_SOURCE instead of the live filesystem
+	SnapshotSource      string           `                   envconfig:"SNAPSHOT_SOURCE"`           // mount point of the filesystem to snapshot
+	SnapshotVolume      string           `                   envconfig:"SNAPSHOT_VOLUME"`           // zfs dataset or lvm volume group/logical volume to snapshot
+	SnapshotSize        string           `default:"1G"       envconfig:"SNAPSHOT_SIZE"`             // space reserved for changes while an lvm snapshot exists
+	StopContainers      bool             `                   envconfig:"DOCKER_STOP_CONTAINERS"`    // stop or pause labelled containers during backups
+	DockerHost          string           `                   envconfig:"DOCKER_HOST"`               // Docker API address, defaults to unix:///var/run/docker.sock
+	DiscoveryInterval   time.Duration    `                   envconfig:"DOCKER_DISCOVERY_INTERVAL"` // how often containers are checked for backup job labels, 0 disables discovery
+	DockerStopTimeout   time.Duration    `default:"30s"      envconfig:"DOCKER_STOP_TIMEOUT"`       // time containers get to stop before they are killed
+	RunOnBoot           bool             `                   envconfig:"RUN_ON_BOOT"`               // run a backup on startup
+	CatchUpWindow       time.Duration    `                   envconfig:"CATCH_UP_WINDOW"`           // run a backup on startup if a scheduled one was missed within this window
+	StateFile           string           `                   envconfig:"STATE_FILE"`                // file to persist the times of the last and last successful backup in
+	TriggerEndpoint     string           `default:"/trigger" envconfig:"TRIGGER_ENDPOINT"`          // trigger endpoint
+	APIEndpoint         string           `                   envconfig:"API_ENDPOINT"`              // snapshot browsing API prefix, empty disables the API
+	PrometheusEndpoint  string           `default:"/metrics" envconfig:"PROMETHEUS_ENDPOINT"`       // metrics endpoint
+	HealthEndpoint      string           `default:"/healthz" envconfig:"HEALTH_ENDPOINT"`           // liveness endpoint on the metrics server
+	ReadyEndpoint       string           `default:"/readyz"  envconfig:"READY_ENDPOINT"`            // readiness endpoint on the metrics server
+	ReadyMaxBackupAge   time.Duration    `                   envconfig:"READY_MAX_BACKUP_AGE"`      // report not ready if the last successful backup is older, 0 disables the check
+	PrometheusAddress   string           `default:":8080"    envconfig:"PROMETHEUS_ADDRESS"`        // metrics host:port
+	TriggerAddress      string           `                   envconfig:"TRIGGER_ADDRESS"`           // trigger and API host:port or unix:path, shares the metrics listener if empty
+	TriggerWaitTimeout  time.Duration    `default:"1h"       envconfig:"TRIGGER_WAIT_TIMEOUT"`      // maximum time a trigger request waits for the backup to complete
+	TriggerAllowedPaths []string         `                   envconfig:"TRIGGER_ALLOWED_PATHS"`     // paths that trigger requests may add to a backup
+	OverlapPolicy       string           `default:"skip"     envconfig:"OVERLAP_POLICY"`            // what to do with runs while a backup is in progress: skip, queue-one or queue-all
+	QueueLimit          int              `default:"10"       envconfig:"QUEUE_LIMIT"`               // maximum number of pending runs with queue-all
+	BackupWindows       windowList       `                   envconfig:"BACKUP_WINDOWS"`            // semicolon-separated windows backups are restricted to, e.g. "Mon-Fri 20:00-06:00"
+	BlackoutPeriods     windowList       `                   envconfig:"BLACKOUT_PERIODS"`          // semicolon-separated windows during which no backups run, e.g. "Mon-Fri 09:00-18:00"
+	DeferTriggers       bool             `                   envconfig:"DEFER_TRIGGERS"`            // defer manual backups outside the windows instead of rejecting them
+	PreCommand          string           `                   envconfig:"PRE_COMMAND"`               // command to execute before restic is executed
+	PostCommand         string           `                   envconfig:"POST_COMMAND"`              // command to execute after restic was executed (successfully)
+	StaleThreshold      time.Duration    `                   envconfig:"STALE_THRESHOLD"`           // notify when no backup succeeded for this long, 0 disables the watchdog
+	StaleCommand        string           `                   envconfig:"STALE_COMMAND"`             // command to execute when backups became stale, defaults to ERROR_COMMAND
+	RecoveredCommand    string           `                   envconfig:"RECOVERED_COMMAND"`         // command to execute when a backup succeeded again after becoming stale
+	ErrorCommand        string           `                   envconfig:"ERROR_COMMAND"`             // command to execute after a failed restic execution
+	TriggerToken        string           `                   envconfig:"TRIGGER_TOKEN"`             // bearer token for the trigger and API endpoints
+	TriggerUsername     string           `                   envconfig:"TRIGGER_USERNAME"`          // basic auth username for the trigger and API endpoints
+	TriggerPassword     string           `                   envconfig:"TRIGGER_PASSWORD"`          // basic auth password for the trigger and API endpoints
+	MetricsToken        string           `                   envconfig:"METRICS_TOKEN"`             // bearer token for the metrics endpoint
+	MetricsUsername     string           `                   envconfig:"METRICS_USERNAME"`          // basic auth username for the metrics endpoint
+	MetricsPassword     string           `                   envconfig:"METRICS_PASSWORD"`          // basic auth password for the metrics endpoint
+	TLSCertFile         string           `                   envconfig:"TLS_CERT_FILE"`             // TLS certificate, reloaded on change
+	TLSKeyFile          string           `                   envconfig:"TLS_KEY_FILE"`              // TLS private key, reloaded on change
+	TLSClientCAFile     string           `                   envconfig:"TLS_CLIENT_CA_FILE"`        // CA bundle to verify client certificates (mTLS)
+	RedactPatterns      regexpList       `                   envconfig:"REDACT_PATTERNS"`           // newline-separated regular expressions to mask in logs
+	ConfigPollInterval  time.Duration    `default:"10s"      envconfig:"CONFIG_POLL_INTERVAL"`      // how often CONFIG_FILE is checked for changes, 0 to only reload on SIGHUP
+}
+
+// loadConfig reads the configuration from the environment
+func loadConfig() (*config, error) {
+	c := &config{}
+	if err := envconfig.Process("", c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
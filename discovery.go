@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// labels describing a backup job on a container
+const (
+	labelPaths       = "restic-robot.paths"
+	labelSchedule    = "restic-robot.schedule"
+	labelTags        = "restic-robot.tags"
+	labelArgs        = "restic-robot.args"
+	labelPreCommand  = "restic-robot.pre-command"
+	labelPostCommand = "restic-robot.post-command"
+)
+
+// dockerJob is a backup job defined by the labels of a container
+type dockerJob struct {
+	name        string
+	schedule    string
+	location    string
+	paths       []string
+	tags        []string
+	args        string
+	preCommand  string
+	postCommand string
+}
+
+// parseDockerJob reads the job definition from the labels of a container. The schedule
+// defaults to SCHEDULE.
+func parseDockerJob(container dockerContainer, cfg *config) (dockerJob, error) {
+	job := dockerJob{
+		name:        container.name(),
+		schedule:    cfg.Schedule,
+		location:    cfg.CronTZ,
+		paths:       splitList(container.Labels[labelPaths]),
+		tags:        splitList(container.Labels[labelTags]),
+		args:        container.Labels[labelArgs],
+		preCommand:  container.Labels[labelPreCommand],
+		postCommand: container.Labels[labelPostCommand],
+	}
+	if schedule := strings.TrimSpace(container.Labels[labelSchedule]); schedule != "" {
+		job.schedule = schedule
+	}
+	if len(job.paths) == 0 {
+		return job, errors.Errorf("%s is empty", labelPaths)
+	}
+	// the same rules as for trigger requests, without restricting the paths
+	opts := job.options()
+	if err := (&config{TriggerAllowedPaths: []string{"/"}}).validateRunOptions(&opts); err != nil {
+		return job, err
+	}
+	job.paths = opts.Paths
+	if _, err := splitArg(job.args); err != nil {
+		return job, errors.Wrap(err, labelArgs)
+	}
+	if _, err := job.config(cfg).parseSchedule(); err != nil {
+		return job, errors.Wrap(err, labelSchedule)
+	}
+	return job, nil
+}
+
+// splitList splits a comma-separated label value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// options returns the overrides of the runs of the job
+func (j dockerJob) options() runOptions {
+	return runOptions{
+		Tags:  append([]string{}, j.tags...),
+		Paths: append([]string{}, j.paths...),
+	}
+}
+
+// config derives the configuration of the job's runs from the global configuration
+func (j dockerJob) config(base *config) *config {
+	c := *base
+	c.Schedule = j.schedule
+	c.CronTZ = j.location
+	c.Args = j.args
+	c.PreCommand = j.preCommand
+	c.PostCommand = j.postCommand
+	c.SourceType = sourceFiles
+	return &c
+}
+
+// discovery keeps backup jobs in sync with the labels of the running containers
+type discovery struct {
+	b    *backup
+	cron *cron.Cron
+	// jobs are the known jobs by container ID
+	jobs map[string]discoveredJob
+}
+
+// discoveredJob is a job known to the discovery, invalid jobs are kept to only report them once
+type discoveredJob struct {
+	job   dockerJob
+	entry cron.EntryID
+	err   error
+}
+
+// newDiscovery creates a discovery submitting runs to the given backup
+func newDiscovery(b *backup) *discovery {
+	return &discovery{
+		b:    b,
+		cron: cron.New(cron.WithParser(scheduleParser)),
+		jobs: make(map[string]discoveredJob),
+	}
+}
+
+// run polls the Docker API for changed containers until the process exits
+func (d *discovery) run(interval time.Duration) {
+	d.cron.Start()
+	for {
+		if err := d.sync(); err != nil {
+			logger.Warn("failed to discover backup jobs", zap.Error(err))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sync creates, updates and removes jobs to match the labels of the running containers
+func (d *discovery) sync() error {
+	cfg := d.b.conf()
+	docker, err := newDockerClient(cfg.dockerHost())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+	containers, err := docker.containers(ctx, labelPaths)
+	if err != nil {
+		return errors.Wrap(err, "listing containers")
+	}
+
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.ID] = true
+	}
+	// removed first, so their jobs don't count against QUEUE_LIMIT
+	for id, known := range d.jobs {
+		if !running[id] {
+			d.remove(id)
+			logger.Info("backup job removed", zap.String("container", known.job.name))
+		}
+	}
+	for _, container := range containers {
+		job, err := parseDockerJob(container, cfg)
+		known, exists := d.jobs[container.ID]
+		limited := false
+		if err == nil && !(exists && known.err == nil) && d.count() >= cfg.QueueLimit {
+			// all jobs due at once have to fit into the queue, or some would be dropped
+			err = errors.Errorf("QUEUE_LIMIT of %d jobs reached", cfg.QueueLimit)
+			limited = true
+		}
+		if exists && reflect.DeepEqual(known.job, job) && (known.err == nil) == (err == nil) {
+			continue
+		}
+		if exists {
+			d.remove(container.ID)
+		}
+		if limited {
+			logger.Warn("backup job not scheduled", zap.String("container", job.name), zap.Error(err))
+			d.jobs[container.ID] = discoveredJob{job: job, err: err}
+			continue
+		}
+		if err != nil {
+			logger.Warn("invalid backup job labels", zap.String("container", job.name), zap.Error(err))
+			d.jobs[container.ID] = discoveredJob{job: job, err: err}
+			continue
+		}
+		d.add(container.ID, job, cfg)
+		if exists {
+			logger.Info("backup job updated", zap.String("container", job.name), zap.String("schedule", job.schedule))
+		} else {
+			logger.Info("backup job discovered", zap.String("container", job.name), zap.String("schedule", job.schedule))
+		}
+	}
+	d.b.discoveredJobs.Set(float64(d.count()))
+	return nil
+}
+
+// add schedules a job
+func (d *discovery) add(id string, job dockerJob, cfg *config) {
+	// validated by parseDockerJob
+	schedule, _ := job.config(cfg).parseSchedule()
+	entry := d.cron.Schedule(schedule, cron.FuncJob(func() {
+		d.b.runJob(job)
+	}))
+	d.jobs[id] = discoveredJob{job: job, entry: entry}
+}
+
+// remove unschedules a job, runs in progress are not affected
+func (d *discovery) remove(id string) {
+	if known, ok := d.jobs[id]; ok && known.err == nil {
+		d.cron.Remove(known.entry)
+	}
+	delete(d.jobs, id)
+}
+
+// count returns the number of valid jobs
+func (d *discovery) count() int {
+	n := 0
+	for _, known := range d.jobs {
+		if known.err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// runJob submits a run of a discovered job and performs it unless it was queued or skipped
+func (b *backup) runJob(job dockerJob) {
+	r := newRun(triggerSchedule, job.options())
+	r.setJob(job.name, job.config(b.conf()))
+	r, start, err := b.submitRun(r)
+	if err != nil {
+		logger.Warn("backup skipped", zap.String("job", job.name), zap.Error(err))
+		return
+	}
+	if start {
+		b.drain(r)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseDockerJob(t *testing.T) {
+	cfg := &config{Schedule: "@daily", Args: "--exclude-caches", PreCommand: "global"}
+	container := dockerContainer{ID: "1", Names: []string{"/db"}, Labels: map[string]string{
+		labelPaths:      "/data/db/, /data/config",
+		labelTags:       "db,critical",
+		labelSchedule:   "0 3 * * *",
+		labelPreCommand: "pg_dumpall -f /data/db/dump.sql",
+	}}
+	job, err := parseDockerJob(container, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, dockerJob{
+		name:       "db",
+		schedule:   "0 3 * * *",
+		paths:      []string{"/data/db", "/data/config"},
+		tags:       []string{"db", "critical"},
+		preCommand: "pg_dumpall -f /data/db/dump.sql",
+	}, job)
+
+	jobCfg := job.config(cfg)
+	assert.Equal(t, "pg_dumpall -f /data/db/dump.sql", jobCfg.PreCommand)
+	assert.Equal(t, []string{"backup", "--json", "--tag", "db", "--tag", "critical", "/data/db", "/data/config"},
+		jobCfg.backupArgs(job.options()))
+
+	// the schedule defaults to SCHEDULE
+	delete(container.Labels, labelSchedule)
+	job, err = parseDockerJob(container, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "@daily", job.schedule)
+
+	for _, labels := range []map[string]string{
+		{labelPaths: ""},
+		{labelPaths: "relative/path"},
+		{labelPaths: "/data", labelTags: "not a tag"},
+		{labelPaths: "/data", labelSchedule: "every day"},
+		{labelPaths: "/data", labelArgs: `--exclude "unterminated`},
+	} {
+		_, err := parseDockerJob(dockerContainer{ID: "2", Labels: labels}, cfg)
+		assert.Error(t, err, labels)
+	}
+}
+
+func Test_discoverySync(t *testing.T) {
+	fake := &fakeDocker{containers: []dockerContainer{
+		{ID: "db", Names: []string{"/db"}, Labels: map[string]string{labelPaths: "/data/db"}},
+		{ID: "web", Names: []string{"/web"}, Labels: map[string]string{labelPaths: "relative"}},
+		{ID: "cache", Names: []string{"/cache"}, Labels: map[string]string{}},
+	}}
+	b := newTestBackup()
+	b.conf().Schedule = "@daily"
+	b.conf().DockerHost = startFakeDocker(t, fake)
+	d := newDiscovery(b)
+
+	require.NoError(t, d.sync())
+	assert.Len(t, d.jobs, 2)
+	assert.Len(t, d.cron.Entries(), 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.discoveredJobs))
+	entry := d.jobs["db"].entry
+
+	// unchanged jobs keep their entry
+	require.NoError(t, d.sync())
+	assert.Equal(t, entry, d.jobs["db"].entry)
+
+	// changed labels replace the job, fixed labels make it valid
+	fake.mu.Lock()
+	fake.containers[0].Labels[labelSchedule] = "@hourly"
+	fake.containers[1].Labels[labelPaths] = "/srv/web"
+	fake.mu.Unlock()
+	require.NoError(t, d.sync())
+	assert.NotEqual(t, entry, d.jobs["db"].entry)
+	assert.Equal(t, "@hourly", d.jobs["db"].job.schedule)
+	assert.Len(t, d.cron.Entries(), 2)
+	assert.Equal(t, 2.0, testutil.ToFloat64(b.discoveredJobs))
+
+	// jobs of removed containers are removed
+	fake.mu.Lock()
+	fake.containers = fake.containers[1:]
+	fake.mu.Unlock()
+	require.NoError(t, d.sync())
+	assert.Len(t, d.jobs, 1)
+	assert.Len(t, d.cron.Entries(), 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.discoveredJobs))
+}
+
+func Test_discoveryQueueLimit(t *testing.T) {
+	fake := &fakeDocker{containers: []dockerContainer{
+		{ID: "db", Names: []string{"/db"}, Labels: map[string]string{labelPaths: "/data/db"}},
+		{ID: "web", Names: []string{"/web"}, Labels: map[string]string{labelPaths: "/data/web"}},
+	}}
+	b := newTestBackup()
+	b.conf().Schedule = "@daily"
+	b.conf().QueueLimit = 1
+	b.conf().DockerHost = startFakeDocker(t, fake)
+	d := newDiscovery(b)
+
+	// jobs which don't fit into the queue are not scheduled
+	require.NoError(t, d.sync())
+	assert.Len(t, d.cron.Entries(), 1)
+	assert.NoError(t, d.jobs["db"].err)
+	assert.EqualError(t, d.jobs["web"].err, "QUEUE_LIMIT of 1 jobs reached")
+
+	// until another job is removed
+	fake.mu.Lock()
+	fake.containers = fake.containers[1:]
+	fake.mu.Unlock()
+	require.NoError(t, d.sync())
+	assert.Len(t, d.cron.Entries(), 1)
+	assert.NoError(t, d.jobs["web"].err)
+}
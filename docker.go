@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// labelStop marks containers which are stopped while a backup runs
+	labelStop = "restic-robot.stop-during-backup"
+	// labelPause marks containers which are paused while a backup runs
+	labelPause = "restic-robot.pause-during-backup"
+
+	// defaultDockerHost is the address of the Docker API unless DOCKER_HOST is set
+	defaultDockerHost = "unix:///var/run/docker.sock"
+	// dockerRequestTimeout limits requests to the Docker API which don't wait for containers
+	dockerRequestTimeout = 30 * time.Second
+)
+
+// dockerClient talks to the Docker Engine API
+type dockerClient struct {
+	client *http.Client
+	base   string
+}
+
+// dockerContainer is a container as returned by the Docker API
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// name returns a human readable name of the container
+func (c dockerContainer) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
+
+// newDockerClient creates a client for a host like unix:///var/run/docker.sock or tcp://host:2375
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Docker host")
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		dialer := &net.Dialer{}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &dockerClient{client: &http.Client{Transport: transport}, base: "http://docker"}, nil
+	case "tcp", "http":
+		return &dockerClient{client: &http.Client{}, base: "http://" + u.Host}, nil
+	case "https":
+		return &dockerClient{client: &http.Client{}, base: "https://" + u.Host}, nil
+	}
+	return nil, errors.Errorf("unsupported Docker host %q", host)
+}
+
+// do performs a request against the API and decodes the response into out, if given
+func (d *dockerClient) do(ctx context.Context, method, path string, query url.Values, out interface{}) error {
+	target := d.base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		// the container already is in the requested state
+		return nil
+	case res.StatusCode >= 300:
+		var msg struct {
+			Message string `json:"message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		if json.Unmarshal(body, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(body))
+		}
+		return errors.Errorf("%s %s: %s: %s", method, path, res.Status, msg.Message)
+	case out != nil:
+		return errors.Wrap(json.NewDecoder(res.Body).Decode(out), "parsing response")
+	}
+	return nil
+}
+
+// ping checks that the API is reachable
+func (d *dockerClient) ping(ctx context.Context) error {
+	return d.do(ctx, http.MethodGet, "/_ping", nil, nil)
+}
+
+// containers lists the running containers matching a label filter like "key" or "key=value"
+func (d *dockerClient) containers(ctx context.Context, label string) ([]dockerContainer, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+	var containers []dockerContainer
+	err = d.do(ctx, http.MethodGet, "/containers/json", url.Values{"filters": {string(filters)}}, &containers)
+	return containers, err
+}
+
+// stop stops a container, killing it after the timeout
+func (d *dockerClient) stop(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{"t": {strconv.Itoa(int(timeout.Seconds()))}}
+	return d.do(ctx, http.MethodPost, "/containers/"+id+"/stop", query, nil)
+}
+
+// start starts a stopped container
+func (d *dockerClient) start(ctx context.Context, id string) error {
+	return d.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil)
+}
+
+// pause freezes all processes of a container
+func (d *dockerClient) pause(ctx context.Context, id string) error {
+	return d.do(ctx, http.MethodPost, "/containers/"+id+"/pause", nil, nil)
+}
+
+// unpause resumes a paused container
+func (d *dockerClient) unpause(ctx context.Context, id string) error {
+	return d.do(ctx, http.MethodPost, "/containers/"+id+"/unpause", nil, nil)
+}
+
+// suspendContainers stops and pauses the labelled containers. The returned function brings
+// them back up and has to be called in any case, including when an error is returned.
+func (c *config) suspendContainers() (func(), error) {
+	if !c.StopContainers {
+		return func() {}, nil
+	}
+	docker, err := newDockerClient(c.dockerHost())
+	if err != nil {
+		return func() {}, err
+	}
+
+	var stopped, paused []dockerContainer
+	var once sync.Once
+	resume := func() {
+		once.Do(func() {
+			// a fresh context, the containers have to come back even if the backup timed out
+			ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+			defer cancel()
+			for _, container := range paused {
+				if err := docker.unpause(ctx, container.ID); err != nil {
+					logger.Error("failed to unpause container", zap.String("container", container.name()), zap.Error(err))
+				} else {
+					logger.Info("unpaused container", zap.String("container", container.name()))
+				}
+			}
+			for _, container := range stopped {
+				if err := docker.start(ctx, container.ID); err != nil {
+					logger.Error("failed to start container", zap.String("container", container.name()), zap.Error(err))
+				} else {
+					logger.Info("started container", zap.String("container", container.name()))
+				}
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+	toStop, err := docker.containers(ctx, labelStop+"=true")
+	if err != nil {
+		return resume, errors.Wrap(err, "listing containers")
+	}
+	toPause, err := docker.containers(ctx, labelPause+"=true")
+	if err != nil {
+		return resume, errors.Wrap(err, "listing containers")
+	}
+	for _, container := range toStop {
+		logger.Info("stopping container", zap.String("container", container.name()))
+		err := c.stopContainer(docker, container)
+		// a failed stop may have happened anyway, starting a running container is a no-op
+		stopped = append(stopped, container)
+		if err != nil {
+			return resume, errors.Wrapf(err, "stopping container %s", container.name())
+		}
+	}
+	for _, container := range toPause {
+		logger.Info("pausing container", zap.String("container", container.name()))
+		if err := docker.pause(ctx, container.ID); err != nil {
+			return resume, errors.Wrapf(err, "pausing container %s", container.name())
+		}
+		paused = append(paused, container)
+	}
+	return resume, nil
+}
+
+// stopContainer stops a container, waiting for it at most the stop timeout
+func (c *config) stopContainer(docker *dockerClient, container dockerContainer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.DockerStopTimeout+dockerRequestTimeout)
+	defer cancel()
+	return docker.stop(ctx, container.ID, c.DockerStopTimeout)
+}
+
+// dockerHost returns the address of the Docker API
+func (c *config) dockerHost() string {
+	if c.DockerHost != "" {
+		return c.DockerHost
+	}
+	return defaultDockerHost
+}
+
+// validateDocker checks that the Docker API is reachable
+func (c *config) validateDocker() error {
+	docker, err := newDockerClient(c.dockerHost())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := docker.ping(ctx); err != nil {
+		return errors.Wrap(err, "cannot reach Docker API")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDocker is a minimal Docker API serving labelled containers
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []dockerContainer
+	calls      []string
+	// fail makes actions on the container with this ID fail
+	fail string
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/_ping" {
+		w.Write([]byte("OK"))
+		return
+	}
+	if r.URL.Path == "/containers/json" {
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		label, value, hasValue := strings.Cut(filters["label"][0], "=")
+		matching := []dockerContainer{}
+		for _, c := range f.containers {
+			if actual, ok := c.Labels[label]; ok && (!hasValue || actual == value) {
+				matching = append(matching, c)
+			}
+		}
+		json.NewEncoder(w).Encode(matching)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	f.calls = append(f.calls, parts[1]+" "+parts[0])
+	if parts[0] == f.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "cannot ` + parts[1] + ` container"}`))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startFakeDocker serves the fake API on a Unix socket and returns its address
+func startFakeDocker(t *testing.T, f *fakeDocker) string {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(f)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return "unix://" + socket
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{containers: []dockerContainer{
+		{ID: "db", Names: []string{"/db"}, Labels: map[string]string{labelStop: "true"}},
+		{ID: "cache", Names: []string{"/cache"}, Labels: map[string]string{labelPause: "true"}},
+		{ID: "web", Names: []string{"/web"}, Labels: map[string]string{labelStop: "false"}},
+	}}
+}
+
+func Test_suspendContainers(t *testing.T) {
+	fake := newFakeDocker()
+	cfg := &config{StopContainers: true, DockerHost: startFakeDocker(t, fake), DockerStopTimeout: 10 * time.Second}
+	require.NoError(t, cfg.validateDocker())
+
+	resume, err := cfg.suspendContainers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"stop db", "pause cache"}, fake.calls)
+
+	resume()
+	resume()
+	assert.Equal(t, []string{"stop db", "pause cache", "unpause cache", "start db"}, fake.calls)
+}
+
+func Test_suspendContainersFailure(t *testing.T) {
+	fake := newFakeDocker()
+	fake.fail = "cache"
+	cfg := &config{StopContainers: true, DockerHost: startFakeDocker(t, fake)}
+
+	resume, err := cfg.suspendContainers()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot pause container")
+
+	// containers stopped before the failure are started again
+	resume()
+	assert.Equal(t, []string{"stop db", "pause cache", "start db"}, fake.calls)
+}
+
+func Test_suspendContainersDisabled(t *testing.T) {
+	cfg := &config{DockerHost: "unix:///nonexistent.sock"}
+	resume, err := cfg.suspendContainers()
+	require.NoError(t, err)
+	resume()
+	assert.Error(t, cfg.validateDocker())
+}
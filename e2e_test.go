@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRepository points restic at a new repository in a temporary directory and returns a
+// directory with data to back up. The test is skipped if restic is not installed.
+func newTestRepository(t *testing.T) string {
+	if _, err := exec.LookPath(resticBinary); err != nil {
+		t.Skip("restic is not installed")
+	}
+	dir := t.TempDir()
+	t.Setenv("RESTIC_REPOSITORY", filepath.Join(dir, "repository"))
+	t.Setenv("RESTIC_PASSWORD", "restic-robot")
+	t.Setenv("RESTIC_CACHE_DIR", filepath.Join(dir, "cache"))
+	data := filepath.Join(dir, "data")
+	require.NoError(t, os.MkdirAll(data, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(data, "file.txt"), []byte("restic-robot"), 0o644))
+	return data
+}
+
+func Test_endToEnd(t *testing.T) {
+	data := newTestRepository(t)
+	b := newTestBackup()
+	require.NoError(t, b.Ensure())
+	// an existing repository is left alone
+	require.NoError(t, b.Ensure())
+
+	for i := 0; i < 2; i++ {
+		r := newRun(triggerManual, runOptions{Tags: []string{"e2e"}, Paths: []string{data}})
+		b.execute(r)
+		result := r.Result()
+		require.Equal(t, runStatusSucceeded, result.Status, result.Error)
+		assert.NotEmpty(t, result.SnapshotID)
+		assert.Equal(t, outcomeSucceeded, result.Phases[phaseStats])
+	}
+
+	ctx := context.Background()
+	runner := execRunner{}
+	snapshots, err := runner.snapshots(ctx, "--tag", "e2e")
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 2)
+
+	stats, err := runner.stats(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, stats.TotalFileCount)
+
+	_, err = runner.forget(ctx, "--keep-last", "1", "--prune")
+	require.NoError(t, err)
+	snapshots, err = runner.snapshots(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+
+	require.NoError(t, runner.check(ctx))
+	require.NoError(t, runner.unlock(ctx))
+}
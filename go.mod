@@ -7,7 +7,7 @@ require (
 	github.com/kelseyhightower/envconfig v1.3.0
 	github.com/pkg/errors v0.8.0
 	github.com/prometheus/client_golang v0.9.0
-	github.com/robfig/cron v0.0.0-20180505203441-b41be1df6967
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/stretchr/testify v1.2.2
 	go.uber.org/zap v1.9.1
 )
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// schedulerGrace is how long the next scheduled run may be overdue before the scheduler is considered stuck
+	schedulerGrace = time.Minute
+	// repositoryCheckInterval limits how often readiness probes access the repository
+	repositoryCheckInterval = time.Minute
+	// repositoryCheckTimeout is the maximum duration of the repository check
+	repositoryCheckTimeout = 30 * time.Second
+
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+// health tracks the state reported by the health endpoints
+type health struct {
+	// started is when the process started, backups are considered recent until the
+	// first one succeeds
+	started time.Time
+	// nextRun and lastSuccess are Unix timestamps, 0 if unknown
+	nextRun     atomic.Int64
+	lastSuccess atomic.Int64
+
+	// mu guards the cached result of the repository check
+	mu                sync.Mutex
+	repositoryChecked time.Time
+	repositoryErr     error
+}
+
+// healthCheck is the outcome of a single check
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthReport is the response of the health endpoints
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+// setupHealth registers the liveness and readiness endpoints, which don't require
+// authentication so that they can be used by orchestrators
+func (b *backup) setupHealth(mux *http.ServeMux) {
+	cfg := b.conf()
+	if cfg.HealthEndpoint != "" {
+		mux.Handle(cfg.HealthEndpoint, healthHandler(b.liveness))
+	}
+	if cfg.ReadyEndpoint != "" {
+		mux.Handle(cfg.ReadyEndpoint, healthHandler(b.readiness))
+	}
+}
+
+// healthHandler renders the checks as JSON, responding with 503 if any of them failed
+func healthHandler(checks func() []healthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		report := healthReport{Status: checkOK, Checks: checks()}
+		status := http.StatusOK
+		for _, check := range report.Checks {
+			if check.Status != checkOK {
+				report.Status = checkFailed
+				status = http.StatusServiceUnavailable
+			}
+		}
+		writeJSON(w, status, report)
+	})
+}
+
+// newCheck returns the outcome of a check
+func newCheck(name string, err error) healthCheck {
+	if err != nil {
+		return healthCheck{Name: name, Status: checkFailed, Error: secrets.redact(err.Error())}
+	}
+	return healthCheck{Name: name, Status: checkOK}
+}
+
+// liveness checks that the process is able to start scheduled backups
+func (b *backup) liveness() []healthCheck {
+	return []healthCheck{newCheck("scheduler", b.checkScheduler(time.Now()))}
+}
+
+// readiness checks that backups can be made and that they are being made
+func (b *backup) readiness() []healthCheck {
+	_, err := exec.LookPath(resticBinary)
+	checks := []healthCheck{
+		newCheck("restic", errors.Wrap(err, "finding restic binary")),
+		newCheck("repository", b.checkRepository()),
+	}
+	if maxAge := b.conf().ReadyMaxBackupAge; maxAge > 0 {
+		checks = append(checks, newCheck("last_backup", b.checkLastBackup(time.Now(), maxAge)))
+	}
+	return checks
+}
+
+// checkScheduler fails if the next scheduled run is overdue, which means the cron loop is stuck
+func (b *backup) checkScheduler(now time.Time) error {
+	next := b.health.nextRun.Load()
+	if next == 0 {
+		return errors.New("no backup scheduled")
+	}
+	if overdue := now.Sub(time.Unix(next, 0)); overdue > schedulerGrace {
+		return errors.Errorf("scheduled backup is overdue by %s", overdue.Round(time.Second))
+	}
+	return nil
+}
+
+// checkRepository reads the repository config to check that it is reachable. The result is
+// cached so that frequent probes don't cause load on the storage.
+func (b *backup) checkRepository() error {
+	h := &b.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.repositoryChecked.IsZero() && time.Since(h.repositoryChecked) < repositoryCheckInterval {
+		return h.repositoryErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), repositoryCheckTimeout)
+	defer cancel()
+	err := b.runner().probe(ctx)
+	h.repositoryChecked = time.Now()
+	h.repositoryErr = errors.Wrap(err, "reading repository config")
+	return h.repositoryErr
+}
+
+// loadLastSuccess restores the time of the last successful backup, so a restart does not
+// make stale backups look recent
+func (b *backup) loadLastSuccess(cfg *config) {
+	last, err := b.lastSuccess(cfg)
+	if err != nil {
+		logger.Warn("failed to determine the last successful backup", zap.Error(err))
+		return
+	}
+	if !last.IsZero() {
+		b.health.lastSuccess.Store(last.Unix())
+	}
+}
+
+// lastBackup returns the time of the last successful backup, or the start of the process if
+// no backup succeeded since
+func (b *backup) lastBackup() (time.Time, bool) {
+	if last := b.health.lastSuccess.Load(); last != 0 {
+		return time.Unix(last, 0), true
+	}
+	return b.health.started, false
+}
+
+// checkLastBackup fails if the last successful backup is older than maxAge
+func (b *backup) checkLastBackup(now time.Time, maxAge time.Duration) error {
+	last, ok := b.lastBackup()
+	age := now.Sub(last).Round(time.Second)
+	if age <= maxAge {
+		return nil
+	}
+	if !ok {
+		return errors.Errorf("no successful backup since startup %s ago", age)
+	}
+	return errors.Errorf("last successful backup was %s ago", age)
+}
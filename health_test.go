@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, b *backup, path string) (int, healthReport) {
+	mux := http.NewServeMux()
+	b.setupHealth(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var report healthReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	return rec.Code, report
+}
+
+func Test_liveness(t *testing.T) {
+	b := newTestBackup()
+	b.conf().HealthEndpoint = "/healthz"
+
+	code, report := getHealth(t, b, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthCheck{Name: "scheduler", Status: checkFailed, Error: "no backup scheduled"}, report.Checks[0])
+
+	b.health.nextRun.Store(time.Now().Add(time.Hour).Unix())
+	code, report = getHealth(t, b, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthReport{Status: checkOK, Checks: []healthCheck{{Name: "scheduler", Status: checkOK}}}, report)
+
+	// a run which should have started long ago means the cron loop is stuck
+	b.health.nextRun.Store(time.Now().Add(-time.Hour).Unix())
+	code, report = getHealth(t, b, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, checkFailed, report.Status)
+	assert.Contains(t, report.Checks[0].Error, "overdue by 1h0m")
+}
+
+func Test_readiness(t *testing.T) {
+	calls := stubCommands(t, "restic")
+	b := newTestBackup()
+	b.conf().ReadyEndpoint = "/readyz"
+	b.conf().ReadyMaxBackupAge = time.Hour
+	b.health.started = time.Now()
+
+	code, report := getHealth(t, b, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []healthCheck{
+		{Name: "restic", Status: checkOK},
+		{Name: "repository", Status: checkOK},
+		{Name: "last_backup", Status: checkOK},
+	}, report.Checks)
+
+	// the repository check is cached
+	getHealth(t, b, "/readyz")
+	assert.Equal(t, []string{"restic --no-lock cat config"}, calls())
+
+	b.health.repositoryChecked = time.Time{}
+	t.Setenv("STUB_FAIL", "restic --no-lock cat config")
+	b.health.started = time.Now().Add(-2 * time.Hour)
+	code, report = getHealth(t, b, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, checkFailed, report.Checks[1].Status)
+	assert.Contains(t, report.Checks[1].Error, "reading repository config: failed")
+	assert.Equal(t, "no successful backup since startup 2h0m0s ago", report.Checks[2].Error)
+
+	b.health.lastSuccess.Store(time.Now().Add(-90 * time.Minute).Unix())
+	_, report = getHealth(t, b, "/readyz")
+	assert.Contains(t, report.Checks[2].Error, "last successful backup was 1h30m")
+
+	b.health.lastSuccess.Store(time.Now().Unix())
+	_, report = getHealth(t, b, "/readyz")
+	assert.Equal(t, checkOK, report.Checks[2].Status)
+}
+
+func Test_checkRepository(t *testing.T) {
+	fake := &fakeRunner{script: map[string]fakeResult{"probe": {err: errors.New("connection refused")}}}
+	b := newTestBackup()
+	b.restic = fake
+
+	assert.EqualError(t, b.checkRepository(), "reading repository config: connection refused")
+	// the result is cached
+	assert.Error(t, b.checkRepository())
+	assert.Equal(t, []string{"probe"}, fake.calls)
+}
@@ -30,7 +30,10 @@ func init() {
 		config.Level.SetLevel(zap.DebugLevel)
 	}
 
-	logger, err = config.Build()
+	logger, err = config.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		// mask secrets in every message and field
+		return newRedactingCore(core, secrets)
+	}))
 	if err != nil {
 		panic(err)
 	}
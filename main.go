@@ -3,38 +3,48 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"os/exec"
+	"os"
 	"regexp"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/joho/godotenv/autoload"
-	"github.com/kelseyhightower/envconfig"
-	"github.com/pkg/errors"
-	"github.com/robfig/cron"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
 type backup struct {
-	Schedule           string `required:"true"    envconfig:"SCHEDULE"`            // cron schedule
-	Repository         string `required:"true"    envconfig:"RESTIC_REPOSITORY"`   // repository name
-	Password           string `required:"true"    envconfig:"RESTIC_PASSWORD"`     // repository password
-	Args               string `                   envconfig:"RESTIC_ARGS"`         // additional args for backup command
-	RunOnBoot          bool   `                   envconfig:"RUN_ON_BOOT"`         // run a backup on startup
-	TriggerEndpoint    string `default:"/trigger" envconfig:"TRIGGER_ENDPOINT"`    // trigger endpoint
-	PrometheusEndpoint string `default:"/metrics" envconfig:"PROMETHEUS_ENDPOINT"` // metrics endpoint
-	PrometheusAddress  string `default:":8080"    envconfig:"PROMETHEUS_ADDRESS"`  // metrics host:port
-	PreCommand         string `                   envconfig:"PRE_COMMAND"`         // command to execute before restic is executed
-	PostCommand        string `                   envconfig:"POST_COMMAND"`        // command to execute after restic was executed (successfully)
-	ErrorCommand       string `                   envconfig:"ERROR_COMMAND"`       // command to execute after a failed restic execution
-
-	// lock is used to prevent concurrent backups from happening
-	lock sync.Mutex
+	// cfg holds the current configuration, which is replaced as a whole on reload
+	cfg atomic.Pointer[config]
+	// queue is used to prevent concurrent backups from happening
+	queue runQueue
+	// history keeps recent runs for lookups through the trigger endpoint
+	history runHistory
 	// metrics defines all the different Prometheus metrics in use
 	metrics
+	// health tracks the state reported by the health endpoints
+	health health
+	// restic invokes restic, the binary is run if it is nil
+	restic resticRunner
+	// resticVersion is the version of the restic binary
+	resticVersion string
+	// ctx is cancelled on shutdown to interrupt the running backup
+	ctx    context.Context
+	cancel context.CancelFunc
+	// running is held for reading by each run, shutdown takes it to wait for their cleanup
+	running sync.RWMutex
+}
+
+// newBackup creates the state of the daemon for the given configuration
+func newBackup(cfg *config) *backup {
+	b := &backup{}
+	b.cfg.Store(cfg)
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return b
 }
 
 var (
@@ -48,148 +58,171 @@ type stats struct {
 	filesProcessed  int
 	bytesAdded      int64
 	bytesProcessed  int64
+	snapshotID      string
 }
 
 func main() {
-	b := backup{}
-	err := envconfig.Process("", &b)
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate())
+	}
+
+	source := newConfigSource()
+	if _, err := source.load(false); err != nil {
+		logger.Fatal("failed to load configuration file", zap.Error(err))
+	}
+	if err := loadSecrets(); err != nil {
+		logger.Fatal("failed to load secrets", zap.Error(err))
+	}
+
+	cfg, err := loadConfig()
 	if err != nil {
 		logger.Fatal("failed to configure", zap.Error(err))
 	}
+	secrets.setPatterns(cfg.RedactPatterns...)
+
+	version, err := validateStartup(cfg)
+	if err != nil {
+		logger.Fatal("failed to validate configuration", zap.Strings("problems", err.(validationErrors)))
+	}
 
+	resticBinary = cfg.ResticBinary
+	b := newBackup(cfg)
+	b.health.started = time.Now()
+	b.resticVersion = logResticVersion(cfg.ResticBinary, version)
 	err = b.Ensure()
 	if err != nil {
 		logger.Fatal("failed to ensure repository", zap.Error(err))
 	}
-	b.initializeMetrics()
-	if b.PrometheusAddress != "" {
-		b.setupTrigger()
-		go b.startMetricsServer()
-	} else {
-		logger.Info("metrics and manual trigger disabled")
-	}
+	b.ensureSecondaries(cfg)
+	b.loadLastSuccess(cfg)
+	b.initializeMetrics(prometheus.DefaultRegisterer)
+	b.startServers()
 
-	cr := cron.New()
-	err = cr.AddJob(b.Schedule, &b)
+	sched := newScheduler(b, func(next time.Time) {
+		b.nextRunTimestamp.Set(float64(next.Unix()))
+		b.health.nextRun.Store(next.Unix())
+	})
+	err = sched.reschedule(cfg)
 	if err != nil {
 		logger.Fatal("failed to schedule task", zap.Error(err))
 	}
-	if b.RunOnBoot {
-		b.Run()
+	// the scheduler has to be running while the first backup is, otherwise the next run
+	// would not be published and a long backup would fail the liveness probe
+	sched.start()
+	if cfg.RunOnBoot {
+		go b.runNow(triggerBoot)
+	} else {
+		go b.catchUp()
+	}
+	go b.watchStaleness()
+	signals := shutdownSignals()
+	go func() {
+		b.shutdownOn(signals, sched)
+		os.Exit(0)
+	}()
+	if cfg.DiscoveryInterval > 0 {
+		go newDiscovery(b).run(cfg.DiscoveryInterval)
 	}
-	cr.Run()
+	b.watchConfig(source, sched)
 }
 
-// Run performs the backup
-func (b *backup) Run() {
-	// prevent concurrent backups from happening
-	if !b.lock.TryLock() {
-		logger.Warn("backup is already running")
-		return
+// validate implements the `validate` command and returns the exit code
+func validate() int {
+	if _, err := newConfigSource().load(false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	// ensure lock is released after backup
-	defer b.lock.Unlock()
-
-	logger.Info("backup started")
-	startTime := time.Now()
-	// hold the backup success
-	success := false
-	b.backupStatus.Set(backupStatusRunning)
-	// process metrics after backup completed
-	defer func() {
-		if success {
-			// last backup succeeded
-			b.backupsSuccessful.Inc()
-			b.backupStatus.Set(backupStatusIdle)
-			b.backupsSuccessfulTimestamp.SetToCurrentTime()
-		} else {
-			// last backup failed
-			b.backupsFailed.Inc()
-			b.backupStatus.Set(backupStatusFailed)
-		}
-		b.backupsTotal.Inc()
-	}()
-
-	// execute pre-command (if configured)
-	if len(b.PreCommand) > 0 {
-		logger.Debug("executing pre-command", zap.String("command", b.PreCommand))
-		if stdout, err := b.executePreCommand(); err != nil {
-			logger.Error("failed to execute pre-command: " + err.Error())
-			return
-		} else {
-			logger.Info("output of pre-command: " + *stdout)
-		}
+	if err := loadSecrets(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err := validateStartup(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("configuration is valid")
+	return 0
+}
 
-	// execute restic backup
-	cmd := exec.Command("restic", append([]string{"backup", "--json"}, parseArg(b.Args)...)...)
-	errbuf := bytes.NewBuffer(nil)
-	outbuf := bytes.NewBuffer(nil)
-	cmd.Stderr = errbuf
-	cmd.Stdout = outbuf
-
-	if err := cmd.Run(); err != nil {
-		logger.Error("failed to run backup",
-			zap.Error(err),
-			zap.String("output", errbuf.String()))
-
-		b.backupStatus.Set(backupStatusFailed)
-		b.backupsFailed.Inc()
-		b.backupsTotal.Inc()
+// conf returns the current configuration
+func (b *backup) conf() *config {
+	return b.cfg.Load()
+}
 
-		// execute error-command (if configured)
-		if len(b.ErrorCommand) > 0 {
-			logger.Debug("executing error-command", zap.String("command", b.ErrorCommand))
-			if stdout, err := b.executeErrorCommand(); err != nil {
-				logger.Error("failed to execute error-command: " + err.Error())
-			} else if stdout != nil {
-				logger.Info("output of error-command: " + *stdout)
-			}
-		}
+// Run performs a scheduled backup
+func (b *backup) Run() {
+	b.runNow(triggerSchedule)
+}
 
+// runNow submits a run and, unless it was queued or skipped, performs it synchronously
+func (b *backup) runNow(trigger string) {
+	r, start, err := b.submit(trigger, runOptions{})
+	if err != nil {
+		logger.Warn("backup skipped", zap.String("trigger", trigger), zap.Error(err))
 		return
 	}
-
-	// execute post-command (if configured)
-	if len(b.PostCommand) > 0 {
-		logger.Debug("executing post-command", zap.String("command", b.PostCommand))
-		if stdout, err := b.executePostCommand(); err != nil {
-			logger.Error("failed to execute post-command: " + err.Error())
-			return
-		} else {
-			logger.Info("output of post-command: " + *stdout)
-		}
+	if start {
+		b.drain(r)
 	}
+}
 
-	d := time.Since(startTime)
+// submit registers a new run and hands it to the queue. If the returned flag is true,
+// the caller is responsible for performing the run by calling drain.
+func (b *backup) submit(trigger string, opts runOptions) (*run, bool, error) {
+	return b.submitRun(newRun(trigger, opts))
+}
 
-	statistics, err := extractJsonStats(outbuf)
+// submitRun hands a new run to the queue, see submit
+func (b *backup) submitRun(r *run) (*run, bool, error) {
+	trigger := r.Result().Trigger
+	cfg := b.conf()
+	if now := time.Now(); !cfg.backupAllowed(now) {
+		// only manual runs are deferred, scheduled ones simply wait for their next turn
+		next, ok := cfg.nextBackupAllowed(now)
+		if trigger != triggerManual || !cfg.DeferTriggers || !ok {
+			b.backupsSkipped.Inc()
+			return nil, false, errOutsideWindow
+		}
+		b.history.add(r)
+		b.deferRun(r, next)
+		return r, false, nil
+	}
+	start, err := b.enqueue(r)
 	if err != nil {
-		logger.Warn("failed to extract statistics from command output",
-			zap.Error(err))
+		return nil, false, err
 	}
+	b.history.add(r)
+	return r, start, nil
+}
 
-	logger.Info("backup completed",
-		zap.Duration("duration", d),
-		zap.Int("filesNew", statistics.filesNew),
-		zap.Int("filesChanged", statistics.filesChanged),
-		zap.Int("filesUnmodified", statistics.filesUnmodified),
-		zap.Int("filesProcessed", statistics.filesProcessed),
-		zap.Int64("bytesAdded", statistics.bytesAdded),
-		zap.Int64("bytesProcessed", statistics.bytesProcessed),
-	)
-
-	// indicate backup success
-	success = true
+// enqueue hands a run to the queue, see runQueue.enqueue
+func (b *backup) enqueue(r *run) (bool, error) {
+	cfg := b.conf()
+	start, err := b.queue.enqueue(r, cfg.OverlapPolicy, cfg.QueueLimit)
+	if err != nil {
+		b.backupsSkipped.Inc()
+		return false, err
+	}
+	if !start {
+		logger.Info("backup queued", zap.String("run", r.ID()), zap.String("trigger", r.Result().Trigger))
+	}
+	b.queueLength.Set(float64(b.queue.length()))
+	return start, nil
+}
 
-	// process result and update metrics
-	b.backupDuration.Observe(float64(d.Milliseconds()))
-	b.filesNew.Observe(float64(statistics.filesNew))
-	b.filesChanged.Observe(float64(statistics.filesChanged))
-	b.filesUnmodified.Observe(float64(statistics.filesUnmodified))
-	b.filesProcessed.Observe(float64(statistics.filesProcessed))
-	b.bytesAdded.Observe(float64(statistics.bytesAdded))
-	b.bytesProcessed.Observe(float64(statistics.bytesProcessed))
+// drain performs the given run followed by all runs queued in the meantime
+func (b *backup) drain(r *run) {
+	for r != nil {
+		b.execute(r)
+		b.recordRun(r)
+		r = b.queue.next()
+		b.queueLength.Set(float64(b.queue.length()))
+	}
 }
 
 func extractJsonStats(outbuf *bytes.Buffer) (result stats, err error) {
@@ -223,6 +256,7 @@ func extractJsonStats(outbuf *bytes.Buffer) (result stats, err error) {
 			result.filesProcessed = summary.TotalFilesProcessed
 			result.bytesAdded = summary.DataAdded
 			result.bytesProcessed = summary.TotalBytesProcessed
+			result.snapshotID = summary.SnapshotID
 		case "status":
 			logger.Debug("received status update", zap.ByteString("line", line))
 		case "error":
@@ -240,25 +274,14 @@ func extractJsonStats(outbuf *bytes.Buffer) (result stats, err error) {
 // Ensure will create a repository if it does not already exist
 func (b *backup) Ensure() error {
 	logger.Info("ensuring backup repository exists")
-	cmd := exec.Command("restic", "init", "--json")
-	outbuf := &bytes.Buffer{}
-	cmd.Stderr = outbuf
-	cmd.Stdout = outbuf
-
-	if err := cmd.Run(); err != nil {
-		outputStr := strings.Trim(outbuf.String(), " \n\r")
-		if matchExists.MatchString(outputStr) {
+	initOutput, err := b.runner().init(context.Background(), nil)
+	if err != nil {
+		if matchExists.MatchString(err.Error()) {
 			logger.Info("repository exists")
 			return nil
 		}
-		logger.Error("failed to initialize repository", zap.Error(err), zap.String("output", outputStr))
-		return errors.Wrap(err, outputStr)
-	}
-
-	var initOutput InitMessage
-	if err := json.Unmarshal(outbuf.Bytes(), &initOutput); err != nil {
-		logger.Error("failed to parse JSON output from restic init", zap.Error(err))
-		return errors.Wrap(err, "parsing JSON output")
+		logger.Error("failed to initialize repository", zap.Error(err))
+		return err
 	}
 
 	logger.Info("successfully created repository", zap.String("id", initOutput.ID), zap.String("repository", initOutput.Repository))
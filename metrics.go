@@ -8,7 +8,6 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.uber.org/zap"
 )
 
 const (
@@ -47,6 +46,9 @@ type metrics struct {
 	backupsFailed              prometheus.Counter
 	backupsSuccessful          prometheus.Counter
 	backupsSuccessfulTimestamp prometheus.Gauge
+	backupsDeferred            prometheus.Counter
+	backupsSkipped             prometheus.Counter
+	backupsStale               prometheus.Gauge
 	backupsTotal               prometheus.Counter
 	bytesAdded                 prometheus.Histogram
 	bytesProcessed             prometheus.Histogram
@@ -54,10 +56,16 @@ type metrics struct {
 	filesNew                   prometheus.Histogram
 	filesProcessed             prometheus.Histogram
 	filesUnmodified            prometheus.Histogram
+	discoveredJobs             prometheus.Gauge
+	nextRunTimestamp           prometheus.Gauge
+	phaseOutcomes              *prometheus.CounterVec
+	queueLength                prometheus.Gauge
+	repositoryRuns             *prometheus.CounterVec
+	repositoryTimestamp        *prometheus.GaugeVec
 }
 
 // initializeMetrics configures and registers the Prometheus metrics
-func (b *backup) initializeMetrics() {
+func (b *backup) initializeMetrics(reg prometheus.Registerer) {
 	b.backupsTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "backup",
 		Name:      "backups_all_total",
@@ -73,6 +81,51 @@ func (b *backup) initializeMetrics() {
 		Name:      "backups_failed_total",
 		Help:      "The total number of backups that failed.",
 	})
+	b.backupsSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "backup",
+		Name:      "backup_skipped_total",
+		Help:      "The total number of backups skipped because another backup was in progress or backups were not allowed.",
+	})
+	b.backupsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "backup",
+		Name:      "backup_deferred_total",
+		Help:      "The total number of manual backups deferred until backups were allowed again.",
+	})
+	b.backupsStale = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "backup",
+		Name:      "backup_stale",
+		Help:      "Whether no backup succeeded within STALE_THRESHOLD (1 = stale, 0 = recent).",
+	})
+	b.queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "backup",
+		Name:      "backup_queue_length",
+		Help:      "The number of backups waiting for the running backup to complete.",
+	})
+	b.nextRunTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "backup",
+		Name:      "backup_next_run_timestamp",
+		Help:      "Timestamp of the next scheduled backup",
+	})
+	b.discoveredJobs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "backup",
+		Name:      "backup_discovered_jobs",
+		Help:      "The number of backup jobs discovered from container labels.",
+	})
+	b.phaseOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "backup",
+		Name:      "backup_phase_total",
+		Help:      "The total number of backup phases (pre-hook, restic, post-hook, stats) per outcome.",
+	}, []string{"phase", "outcome"})
+	b.repositoryRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "backup",
+		Name:      "backup_repository_runs_total",
+		Help:      "The total number of backups and copies per repository and status.",
+	}, []string{"repository", "status"})
+	b.repositoryTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "backup",
+		Name:      "backup_repository_successful_timestamp",
+		Help:      "Timestamp of the last successful backup or copy per repository",
+	}, []string{"repository"})
 	b.backupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "backup",
 		Name:      "backup_duration_milliseconds",
@@ -129,23 +182,32 @@ func (b *backup) initializeMetrics() {
 		Namespace:   "backup",
 		Name:        "backup_info",
 		Help:        "Information about the backup process",
-		ConstLabels: prometheus.Labels(getVersionInfo()),
+		ConstLabels: prometheus.Labels(b.versionInfo()),
 	})
 	b.backupInfo.Set(1)
-	prometheus.MustRegister(
+	reg.MustRegister(
 		b.backupDuration,
 		b.backupInfo,
 		b.backupStatus,
+		b.backupsDeferred,
 		b.backupsFailed,
+		b.backupsSkipped,
+		b.backupsStale,
 		b.backupsSuccessful,
 		b.backupsSuccessfulTimestamp,
 		b.backupsTotal,
 		b.bytesAdded,
 		b.bytesProcessed,
+		b.discoveredJobs,
 		b.filesChanged,
 		b.filesNew,
 		b.filesProcessed,
 		b.filesUnmodified,
+		b.nextRunTimestamp,
+		b.phaseOutcomes,
+		b.queueLength,
+		b.repositoryRuns,
+		b.repositoryTimestamp,
 	)
 }
 
@@ -162,6 +224,13 @@ func getBuildInfo(key string) string {
 	return ""
 }
 
+// versionInfo returns the labels of the info metric, including the version of restic
+func (b *backup) versionInfo() map[string]string {
+	labels := getVersionInfo()
+	labels["restic_version"] = b.resticVersion
+	return labels
+}
+
 // getVersionInfo returns a list of key value pairs to become part of the info metric
 func getVersionInfo() map[string]string {
 	res := make(map[string]string)
@@ -182,9 +251,9 @@ func getVersionInfo() map[string]string {
 	return res
 }
 
-func (b *backup) startMetricsServer() {
-	http.Handle(b.PrometheusEndpoint, promhttp.Handler())
-	logger.Info("metrics server listening at " + b.PrometheusAddress)
-	err := http.ListenAndServe(b.PrometheusAddress, nil)
-	logger.Fatal("metrics server closed", zap.Error(err))
+// setupMetrics registers the Prometheus metrics handler and the health endpoints
+func (b *backup) setupMetrics(mux *http.ServeMux) {
+	cfg := b.conf()
+	mux.Handle(cfg.PrometheusEndpoint, requireAuth(cfg.metricsCredentials(), promhttp.Handler()))
+	b.setupHealth(mux)
 }
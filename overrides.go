@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxOverrideBodySize limits the size of a trigger request body
+	maxOverrideBodySize = 64 * 1024
+)
+
+var (
+	// matchTag matches tags that restic accepts without splitting them
+	matchTag = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+	// matchHost matches valid host names
+	matchHost = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+)
+
+// runOptions are per-run additions to the configured backup arguments
+type runOptions struct {
+	Tags  []string `json:"tags,omitempty"`
+	Paths []string `json:"paths,omitempty"`
+	Host  string   `json:"host,omitempty"`
+}
+
+// empty returns true if no overrides are set
+func (o runOptions) empty() bool {
+	return len(o.Tags) == 0 && len(o.Paths) == 0 && o.Host == ""
+}
+
+// parseRunOptions reads the optional JSON body of a trigger request
+func parseRunOptions(r *http.Request) (runOptions, error) {
+	var opts runOptions
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxOverrideBodySize+1))
+	if err != nil {
+		return opts, errors.Wrap(err, "reading request body")
+	}
+	if len(body) > maxOverrideBodySize {
+		return opts, errors.New("request body too large")
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return opts, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&opts); err != nil {
+		return opts, errors.Wrap(err, "parsing request body")
+	}
+	return opts, nil
+}
+
+// validateRunOptions checks the overrides and restricts paths to the configured allow-list
+func (c *config) validateRunOptions(opts *runOptions) error {
+	for _, tag := range opts.Tags {
+		if !matchTag.MatchString(tag) {
+			return errors.Errorf("invalid tag %q", tag)
+		}
+	}
+	if opts.Host != "" && !matchHost.MatchString(opts.Host) {
+		return errors.Errorf("invalid host %q", opts.Host)
+	}
+	if len(opts.Paths) > 0 && c.SourceType != sourceFiles {
+		return errors.New("path overrides are not possible with SOURCE_TYPE")
+	}
+	if len(opts.Paths) > 0 && len(c.TriggerAllowedPaths) == 0 {
+		return errors.New("path overrides are disabled")
+	}
+	for i, path := range opts.Paths {
+		if !filepath.IsAbs(path) {
+			return errors.Errorf("path %q is not absolute", path)
+		}
+		cleaned := filepath.Clean(path)
+		if !pathAllowed(cleaned, c.TriggerAllowedPaths) {
+			return errors.Errorf("path %q is not allowed", path)
+		}
+		opts.Paths[i] = cleaned
+	}
+	return nil
+}
+
+// pathAllowed returns true if the path equals or is below one of the allowed paths
+func pathAllowed(path string, allowed []string) bool {
+	for _, prefix := range allowed {
+		prefix = filepath.Clean(prefix)
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// backupArgs assembles the arguments of `restic backup` from the configuration and run overrides
+func (c *config) backupArgs(opts runOptions) []string {
+	args := []string{"backup", "--json"}
+	if c.SourceType != sourceFiles {
+		args = append(args, "--stdin", "--stdin-filename", c.sourceFilename())
+	}
+	args = append(args, parseArg(c.Args)...)
+	for _, tag := range opts.Tags {
+		args = append(args, "--tag", tag)
+	}
+	if opts.Host != "" {
+		args = append(args, "--host", opts.Host)
+	}
+	return append(args, opts.Paths...)
+}
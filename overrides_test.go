@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validateRunOptions(t *testing.T) {
+	b := &config{TriggerAllowedPaths: []string{"/data", "/srv/app/"}}
+	tests := []struct {
+		name      string
+		opts      runOptions
+		wantPaths []string
+		wantErr   bool
+	}{
+		{"empty", runOptions{}, nil, false},
+		{"tags and host", runOptions{Tags: []string{"pre-migration", "v1.2"}, Host: "db-1"}, nil, false},
+		{"tag with comma", runOptions{Tags: []string{"a,b"}}, nil, true},
+		{"tag with flag", runOptions{Tags: []string{"--exclude"}}, nil, true},
+		{"invalid host", runOptions{Host: "db 1"}, nil, true},
+		{"allowed path", runOptions{Paths: []string{"/data/db/"}}, []string{"/data/db"}, false},
+		{"allowed root", runOptions{Paths: []string{"/srv/app"}}, []string{"/srv/app"}, false},
+		{"relative path", runOptions{Paths: []string{"data"}}, nil, true},
+		{"traversal", runOptions{Paths: []string{"/data/../etc"}}, nil, true},
+		{"sibling prefix", runOptions{Paths: []string{"/database"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.validateRunOptions(&tt.opts)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantPaths, tt.opts.Paths)
+		})
+	}
+
+	t.Run("paths disabled", func(t *testing.T) {
+		err := (&config{}).validateRunOptions(&runOptions{Paths: []string{"/data"}})
+		assert.Error(t, err)
+	})
+}
+
+func Test_parseRunOptions(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/trigger", strings.NewReader(`{"tags":["pre-migration"],"paths":["/data"],"host":"db-1"}`))
+	opts, err := parseRunOptions(r)
+	assert.NoError(t, err)
+	assert.Equal(t, runOptions{Tags: []string{"pre-migration"}, Paths: []string{"/data"}, Host: "db-1"}, opts)
+
+	r = httptest.NewRequest(http.MethodPost, "/trigger", nil)
+	opts, err = parseRunOptions(r)
+	assert.NoError(t, err)
+	assert.True(t, opts.empty())
+
+	r = httptest.NewRequest(http.MethodPost, "/trigger", strings.NewReader(`{"args":["--exclude","*"]}`))
+	_, err = parseRunOptions(r)
+	assert.Error(t, err)
+}
+
+func Test_backupArgs(t *testing.T) {
+	b := &config{Args: "/srv --exclude \"*.tmp\""}
+	args := b.backupArgs(runOptions{Tags: []string{"pre-migration"}, Host: "db-1", Paths: []string{"/data"}})
+	assert.Equal(t, []string{
+		"backup", "--json", "/srv", "--exclude", "*.tmp",
+		"--tag", "pre-migration", "--host", "db-1", "/data",
+	}, args)
+}
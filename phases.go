@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// phases of a run, in the order they are performed
+const (
+	phasePreHook  = "pre-hook"
+	phaseRestic   = "restic"
+	phasePostHook = "post-hook"
+	phaseStats    = "stats"
+)
+
+// outcomes of a phase
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+	outcomeSkipped   = "skipped"
+)
+
+// runPhases are all phases of a run
+var runPhases = []string{phasePreHook, phaseRestic, phasePostHook, phaseStats}
+
+// runOutcome is the result of executing a run, from which all of its metrics, logs and
+// notifications are derived
+type runOutcome struct {
+	// phases holds the outcome of each phase, phases which were not performed are skipped
+	phases map[string]string
+	// err is the failure which kept the snapshot from being created, nil if it was
+	err error
+	// warnings are failures of the phases following the snapshot, they don't fail the run
+	warnings []error
+	// output is the error output of restic
+	output   string
+	duration time.Duration
+	// statistics are nil unless they could be read from the output of restic
+	statistics *stats
+}
+
+// newRunOutcome returns an outcome with all phases skipped
+func newRunOutcome() *runOutcome {
+	o := &runOutcome{phases: make(map[string]string)}
+	for _, phase := range runPhases {
+		o.phases[phase] = outcomeSkipped
+	}
+	return o
+}
+
+// record sets the outcome of a phase and returns its error
+func (o *runOutcome) record(phase string, err error) error {
+	if err != nil {
+		o.phases[phase] = outcomeFailed
+	} else {
+		o.phases[phase] = outcomeSucceeded
+	}
+	return err
+}
+
+// succeeded returns true if the snapshot was created
+func (o *runOutcome) succeeded() bool {
+	return o.err == nil
+}
+
+// snapshotID returns the ID of the created snapshot, if it is known
+func (o *runOutcome) snapshotID() string {
+	if o.statistics == nil {
+		return ""
+	}
+	return o.statistics.snapshotID
+}
+
+// warningMessages returns the redacted warnings for the run result
+func (o *runOutcome) warningMessages() []string {
+	var messages []string
+	for _, err := range o.warnings {
+		messages = append(messages, secrets.redact(err.Error()))
+	}
+	return messages
+}
+
+// execute performs the backup of a run
+func (b *backup) execute(r *run) {
+	// the configuration may be reloaded while the backup is running
+	cfg := b.conf()
+	if r.cfg != nil {
+		cfg = r.cfg
+	}
+	b.running.RLock()
+	defer b.running.RUnlock()
+	if b.ctx.Err() != nil {
+		// containers are not touched anymore once the process is exiting
+		r.finish(errShutdown, nil)
+		return
+	}
+	r.setStatus(runStatusRunning)
+	logger.Info("backup started", zap.String("run", r.ID()), zap.String("trigger", r.Result().Trigger))
+	b.backupStatus.Set(backupStatusRunning)
+
+	o := b.perform(cfg, r)
+	b.finishRun(cfg, r, o)
+}
+
+// perform runs the phases of a run. A failing phase before the snapshot was created fails
+// the run and skips the remaining phases, later failures are recorded as warnings.
+func (b *backup) perform(cfg *config, r *run) *runOutcome {
+	o := newRunOutcome()
+	startTime := time.Now()
+
+	if cfg.PreCommand != "" {
+		if err := o.record(phasePreHook, runHook("pre-command", cfg.PreCommand)); err != nil {
+			o.err = errors.Wrap(err, "pre-command")
+			return o
+		}
+	}
+
+	out, err := b.backupPrimary(cfg, r)
+	o.output = out.stderr
+	if err := o.record(phaseRestic, err); err != nil {
+		o.err = err
+		return o
+	}
+
+	if cfg.PostCommand != "" {
+		if err := o.record(phasePostHook, runHook("post-command", cfg.PostCommand)); err != nil {
+			o.warnings = append(o.warnings, errors.Wrap(err, "post-command"))
+		}
+	}
+	o.duration = time.Since(startTime)
+
+	statistics, err := extractJsonStats(bytes.NewBuffer(out.stdout))
+	if err == nil && statistics.snapshotID == "" {
+		err = errors.New("no summary in restic output")
+	}
+	if err := o.record(phaseStats, err); err != nil {
+		o.warnings = append(o.warnings, errors.Wrap(err, "statistics"))
+	} else {
+		o.statistics = &statistics
+	}
+
+	if cfg.SecondaryMode == secondaryCopy {
+		b.copySecondaries(cfg, r, o.snapshotID())
+	}
+	return o
+}
+
+// backupPrimary runs restic against the primary repository, with containers suspended and
+// from a filesystem snapshot if configured
+func (b *backup) backupPrimary(cfg *config, r *run) (backupOutput, error) {
+	// stop and pause labelled containers (if configured), they are always brought back up
+	resume, err := cfg.suspendContainers()
+	defer resume()
+	if err != nil {
+		return backupOutput{}, errors.Wrap(err, "docker")
+	}
+
+	// take a filesystem snapshot (if configured), which is always removed again
+	snapshot, removeSnapshot, err := cfg.takeSnapshot()
+	defer removeSnapshot()
+	if err != nil {
+		return backupOutput{}, err
+	}
+	if snapshot != "" {
+		// the snapshot is consistent, containers don't have to wait for restic
+		resume()
+	}
+
+	th := cfg.throttleAt(time.Now())
+	ctx, cancel := cfg.sourceContext(b.ctx)
+	defer cancel()
+	logger.Debug("throttling backup",
+		zap.Int("limitUpload", th.limitUpload),
+		zap.Int("limitDownload", th.limitDownload),
+		zap.Int("nice", th.nice),
+		zap.Stringer("ionice", th.ionice))
+	out, err := b.runner().backup(ctx, backupRequest{
+		args:           cfg.backupArgs(r.options),
+		throttle:       th,
+		source:         cfg.sourceCommand(ctx),
+		snapshot:       snapshot,
+		snapshotSource: cfg.SnapshotSource,
+	})
+	if out.source != nil {
+		r.setSource(out.source)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = errors.Wrapf(err, "timed out after %s", cfg.SourceTimeout)
+	}
+	if err != nil && b.ctx.Err() != nil {
+		err = errors.Wrap(err, "interrupted by shutdown")
+	}
+	if err == nil && cfg.SecondaryMode == secondaryBackup {
+		// from the same snapshot, and with containers still suspended if there is none
+		b.backupSecondaries(cfg, r, snapshot, th)
+	}
+	return out, errors.Wrap(err, "restic backup")
+}
+
+// finishRun derives the metrics, logs and notifications of a run from its outcome
+func (b *backup) finishRun(cfg *config, r *run, o *runOutcome) {
+	for _, phase := range runPhases {
+		b.phaseOutcomes.WithLabelValues(phase, o.phases[phase]).Inc()
+	}
+	b.backupsTotal.Inc()
+	b.recordRepository(primaryRepository, o.succeeded())
+	r.setPhases(o.phases, o.warningMessages())
+
+	if !o.succeeded() {
+		b.backupsFailed.Inc()
+		b.backupStatus.Set(backupStatusFailed)
+		logger.Error("failed to run backup",
+			zap.String("run", r.ID()),
+			zap.Error(o.err),
+			zap.String("output", o.output))
+		runHook("error-command", cfg.ErrorCommand)
+		r.finish(o.err, nil)
+		return
+	}
+
+	b.backupsSuccessful.Inc()
+	b.backupStatus.Set(backupStatusIdle)
+	b.backupsSuccessfulTimestamp.SetToCurrentTime()
+	if r.Result().Job == "" {
+		// staleness is about the main schedule, discovered jobs don't stand in for it
+		b.health.lastSuccess.Store(time.Now().Unix())
+	}
+	b.backupDuration.Observe(float64(o.duration.Milliseconds()))
+
+	fields := []zap.Field{zap.String("run", r.ID()), zap.Duration("duration", o.duration)}
+	if s := o.statistics; s != nil {
+		b.filesNew.Observe(float64(s.filesNew))
+		b.filesChanged.Observe(float64(s.filesChanged))
+		b.filesUnmodified.Observe(float64(s.filesUnmodified))
+		b.filesProcessed.Observe(float64(s.filesProcessed))
+		b.bytesAdded.Observe(float64(s.bytesAdded))
+		b.bytesProcessed.Observe(float64(s.bytesProcessed))
+		fields = append(fields,
+			zap.Int("filesNew", s.filesNew),
+			zap.Int("filesChanged", s.filesChanged),
+			zap.Int("filesUnmodified", s.filesUnmodified),
+			zap.Int("filesProcessed", s.filesProcessed),
+			zap.Int64("bytesAdded", s.bytesAdded),
+			zap.Int64("bytesProcessed", s.bytesProcessed))
+	}
+	if len(o.warnings) > 0 {
+		logger.Warn("backup completed with warnings", append(fields, zap.Errors("warnings", o.warnings))...)
+	} else {
+		logger.Info("backup completed", fields...)
+	}
+	r.finish(nil, o.statistics)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRestic logs its invocation, prints $FAKE_RESTIC_OUTPUT and exits with $FAKE_RESTIC_EXIT
+const fakeRestic = `#!/bin/sh
+echo "restic $*" >> "$STUB_LOG"
+printf '%s\n' "$FAKE_RESTIC_OUTPUT"
+echo "restic error output" >&2
+exit "${FAKE_RESTIC_EXIT:-0}"
+`
+
+// summaryOutput is the JSON output of a successful `restic backup`
+const summaryOutput = `{"message_type":"status","percent_done":1}
+{"message_type":"summary","files_new":3,"files_changed":1,"data_added":1024,"snapshot_id":"1a2b3c"}`
+
+func Test_execute(t *testing.T) {
+	tests := []struct {
+		name         string
+		fail         string
+		exit         string
+		output       string
+		wantStatus   string
+		wantPhases   map[string]string
+		wantCalls    []string
+		wantWarnings int
+	}{
+		{
+			name:       "success",
+			output:     summaryOutput,
+			wantStatus: runStatusSucceeded,
+			wantPhases: map[string]string{
+				phasePreHook: outcomeSucceeded, phaseRestic: outcomeSucceeded,
+				phasePostHook: outcomeSucceeded, phaseStats: outcomeSucceeded,
+			},
+			wantCalls: []string{"hook pre", "restic backup --json /data", "hook post"},
+		},
+		{
+			name:       "pre-hook fails",
+			fail:       "hook pre",
+			output:     summaryOutput,
+			wantStatus: runStatusFailed,
+			wantPhases: map[string]string{
+				phasePreHook: outcomeFailed, phaseRestic: outcomeSkipped,
+				phasePostHook: outcomeSkipped, phaseStats: outcomeSkipped,
+			},
+			wantCalls: []string{"hook pre", "hook error"},
+		},
+		{
+			name:       "restic fails",
+			exit:       "1",
+			wantStatus: runStatusFailed,
+			wantPhases: map[string]string{
+				phasePreHook: outcomeSucceeded, phaseRestic: outcomeFailed,
+				phasePostHook: outcomeSkipped, phaseStats: outcomeSkipped,
+			},
+			wantCalls: []string{"hook pre", "restic backup --json /data", "hook error"},
+		},
+		{
+			// the snapshot exists, so the run succeeds
+			name:       "post-hook fails",
+			fail:       "hook post",
+			output:     summaryOutput,
+			wantStatus: runStatusSucceeded,
+			wantPhases: map[string]string{
+				phasePreHook: outcomeSucceeded, phaseRestic: outcomeSucceeded,
+				phasePostHook: outcomeFailed, phaseStats: outcomeSucceeded,
+			},
+			wantCalls:    []string{"hook pre", "restic backup --json /data", "hook post"},
+			wantWarnings: 1,
+		},
+		{
+			name:       "stats fail",
+			output:     `{"message_type":"status"}`,
+			wantStatus: runStatusSucceeded,
+			wantPhases: map[string]string{
+				phasePreHook: outcomeSucceeded, phaseRestic: outcomeSucceeded,
+				phasePostHook: outcomeSucceeded, phaseStats: outcomeFailed,
+			},
+			wantCalls:    []string{"hook pre", "restic backup --json /data", "hook post"},
+			wantWarnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := stubCommands(t, "hook")
+			dir := filepath.Dir(os.Getenv("STUB_LOG"))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "restic"), []byte(fakeRestic), 0o755))
+			t.Setenv("STUB_FAIL", tt.fail)
+			t.Setenv("FAKE_RESTIC_EXIT", tt.exit)
+			t.Setenv("FAKE_RESTIC_OUTPUT", tt.output)
+
+			b := newTestBackup()
+			cfg := b.conf()
+			cfg.PreCommand = "hook pre"
+			cfg.PostCommand = "hook post"
+			cfg.ErrorCommand = "hook error"
+			r := newRun(triggerManual, runOptions{Paths: []string{"/data"}})
+			b.execute(r)
+
+			result := r.Result()
+			assert.Equal(t, tt.wantStatus, result.Status)
+			assert.Equal(t, tt.wantPhases, result.Phases)
+			assert.Len(t, result.Warnings, tt.wantWarnings)
+			assert.Equal(t, tt.wantCalls, calls())
+
+			// every run is counted exactly once
+			succeeded := 0.0
+			if tt.wantStatus == runStatusSucceeded {
+				succeeded = 1
+			}
+			assert.Equal(t, 1.0, testutil.ToFloat64(b.backupsTotal))
+			assert.Equal(t, succeeded, testutil.ToFloat64(b.backupsSuccessful))
+			assert.Equal(t, 1-succeeded, testutil.ToFloat64(b.backupsFailed))
+			assert.Equal(t, 1.0, testutil.ToFloat64(b.repositoryRuns.WithLabelValues(primaryRepository, tt.wantStatus)))
+			for phase, outcome := range tt.wantPhases {
+				assert.Equal(t, 1.0, testutil.ToFloat64(b.phaseOutcomes.WithLabelValues(phase, outcome)), phase)
+			}
+
+			if tt.wantStatus == runStatusFailed {
+				assert.Nil(t, result.Stats)
+				assert.Equal(t, float64(backupStatusFailed), testutil.ToFloat64(b.backupStatus))
+				return
+			}
+			assert.Equal(t, float64(backupStatusIdle), testutil.ToFloat64(b.backupStatus))
+			assert.NotZero(t, b.health.lastSuccess.Load())
+			if tt.wantPhases[phaseStats] == outcomeSucceeded {
+				require.NotNil(t, result.Stats)
+				assert.Equal(t, 3, result.Stats.filesNew)
+				assert.Equal(t, int64(1024), result.Stats.bytesAdded)
+				assert.Equal(t, "1a2b3c", result.SnapshotID)
+			} else {
+				assert.Nil(t, result.Stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// overlapSkip drops runs submitted while a backup is in progress
+	overlapSkip = "skip"
+	// overlapQueueOne keeps a single pending run and drops any further ones
+	overlapQueueOne = "queue-one"
+	// overlapQueueAll keeps pending runs up to the queue limit
+	overlapQueueAll = "queue-all"
+)
+
+var (
+	// errBackupRunning is returned when a run is skipped because of the overlap policy
+	errBackupRunning = errors.New("backup is already running")
+	// errQueueFull is returned when a run is skipped because the queue is full
+	errQueueFull = errors.New("backup queue is full")
+)
+
+// runQueue serializes backups and applies the overlap policy to runs
+// submitted while another backup is in progress
+type runQueue struct {
+	mu      sync.Mutex
+	running bool
+	pending []*run
+}
+
+// enqueue returns true if the run may start right away, in which case the caller has to
+// drain the queue. Otherwise the run is either queued or rejected with an error.
+func (q *runQueue) enqueue(r *run, policy string, limit int) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.running {
+		q.running = true
+		return true, nil
+	}
+	switch policy {
+	case overlapQueueOne:
+		if len(q.pending) >= 1 {
+			return false, errQueueFull
+		}
+	case overlapQueueAll:
+		if len(q.pending) >= limit {
+			return false, errQueueFull
+		}
+	default:
+		return false, errBackupRunning
+	}
+	r.setStatus(runStatusQueued)
+	q.pending = append(q.pending, r)
+	return false, nil
+}
+
+// next pops the next pending run, or marks the queue idle and returns nil if there is none
+func (q *runQueue) next() *run {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		q.running = false
+		return nil
+	}
+	r := q.pending[0]
+	q.pending = q.pending[1:]
+	return r
+}
+
+// length returns the number of pending runs
+func (q *runQueue) length() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// validOverlapPolicy returns true if the policy is known
+func validOverlapPolicy(policy string) bool {
+	switch policy {
+	case overlapSkip, overlapQueueOne, overlapQueueAll:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_runQueue(t *testing.T) {
+	tests := []struct {
+		policy      string
+		limit       int
+		wantQueued  int
+		wantSkipped int
+	}{
+		{overlapSkip, 10, 0, 3},
+		{overlapQueueOne, 10, 1, 2},
+		{overlapQueueAll, 2, 2, 1},
+		{overlapQueueAll, 10, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			q := runQueue{}
+			start, err := q.enqueue(newRun(triggerSchedule, runOptions{}), tt.policy, tt.limit)
+			assert.True(t, start)
+			assert.NoError(t, err)
+
+			queued, skipped := 0, 0
+			for i := 0; i < 3; i++ {
+				start, err := q.enqueue(newRun(triggerManual, runOptions{}), tt.policy, tt.limit)
+				assert.False(t, start)
+				if err != nil {
+					skipped++
+				} else {
+					queued++
+				}
+			}
+			assert.Equal(t, tt.wantQueued, queued)
+			assert.Equal(t, tt.wantSkipped, skipped)
+			assert.Equal(t, tt.wantQueued, q.length())
+
+			// pending runs are handed out in order until the queue becomes idle
+			for i := 0; i < tt.wantQueued; i++ {
+				assert.NotNil(t, q.next())
+			}
+			assert.Nil(t, q.next())
+			start, err = q.enqueue(newRun(triggerSchedule, runOptions{}), tt.policy, tt.limit)
+			assert.True(t, start)
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// restartSettings cannot be changed by a reload because they are only used at startup
+var restartSettings = map[string]bool{
+	"PROMETHEUS_ADDRESS":        true,
+	"PROMETHEUS_ENDPOINT":       true,
+	"TRIGGER_ADDRESS":           true,
+	"TRIGGER_ENDPOINT":          true,
+	"API_ENDPOINT":              true,
+	"HEALTH_ENDPOINT":           true,
+	"READY_ENDPOINT":            true,
+	"TRIGGER_TOKEN":             true,
+	"TRIGGER_USERNAME":          true,
+	"TRIGGER_PASSWORD":          true,
+	"METRICS_TOKEN":             true,
+	"METRICS_USERNAME":          true,
+	"METRICS_PASSWORD":          true,
+	"TLS_CERT_FILE":             true,
+	"TLS_KEY_FILE":              true,
+	"TLS_CLIENT_CA_FILE":        true,
+	"RUN_ON_BOOT":               true,
+	"RESTIC_BINARY":             true,
+	"CONFIG_POLL_INTERVAL":      true,
+	"DOCKER_DISCOVERY_INTERVAL": true,
+}
+
+// configSource loads settings from an optional dotenv file into the environment.
+// Variables set in the environment of the process take precedence over the file.
+type configSource struct {
+	path string
+	// fileKeys are the variables which were set from the file
+	fileKeys map[string]bool
+	modTime  time.Time
+}
+
+// newConfigSource creates a source for the dotenv file named by CONFIG_FILE, defaulting to .env
+func newConfigSource() *configSource {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		path = ".env"
+	}
+	return &configSource{path: path, fileKeys: make(map[string]bool)}
+}
+
+// load applies the file to the environment and returns a function to undo the changes
+func (s *configSource) load(reload bool) (func(), error) {
+	modTime := s.currentModTime()
+	values, err := godotenv.Read(s.path)
+	if os.IsNotExist(errors.Cause(err)) {
+		values, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading configuration file")
+	}
+
+	previous := make(map[string]string)
+	for key := range s.fileKeys {
+		previous[key] = os.Getenv(key)
+	}
+	previousKeys := s.fileKeys
+	previousModTime := s.modTime
+
+	keys := make(map[string]bool)
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set && !s.fileKeys[key] {
+			continue
+		}
+		if reload && reloadSkipped(key) {
+			// secrets are resolved once at startup
+			if s.fileKeys[key] {
+				keys[key] = true
+			}
+			continue
+		}
+		os.Setenv(key, value)
+		keys[key] = true
+	}
+	for key := range s.fileKeys {
+		if !keys[key] {
+			os.Unsetenv(key)
+		}
+	}
+	s.fileKeys = keys
+	s.modTime = modTime
+
+	return func() {
+		for key := range s.fileKeys {
+			if _, ok := previous[key]; !ok {
+				os.Unsetenv(key)
+			}
+		}
+		for key, value := range previous {
+			os.Setenv(key, value)
+		}
+		s.fileKeys = previousKeys
+		s.modTime = previousModTime
+	}, nil
+}
+
+// reloadSkipped returns true for variables which are only read at startup to resolve secrets
+func reloadSkipped(key string) bool {
+	if key == "RESTIC_PASSWORD_COMMAND" {
+		return true
+	}
+	_, ok := secretFile(key)
+	return ok
+}
+
+// currentModTime returns the modification time of the file, or zero if it does not exist
+func (s *configSource) currentModTime() time.Time {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// changed returns true if the file was modified, created or removed since it was last loaded
+func (s *configSource) changed() bool {
+	return !s.currentModTime().Equal(s.modTime)
+}
+
+// watchConfig reloads the configuration on SIGHUP or when the configuration file changes
+func (b *backup) watchConfig(source *configSource, sched *scheduler) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var poll <-chan time.Time
+	if interval := b.conf().ConfigPollInterval; interval > 0 {
+		poll = time.NewTicker(interval).C
+	}
+	for {
+		select {
+		case <-hup:
+			logger.Info("received SIGHUP, reloading configuration")
+			b.reload(source, sched)
+		case <-poll:
+			if source.changed() {
+				logger.Info("configuration file changed, reloading configuration", zap.String("file", source.path))
+				b.reload(source, sched)
+			}
+		}
+	}
+}
+
+// reload reads and validates the configuration and swaps it in without interrupting a
+// running backup, which keeps using the configuration it was started with
+func (b *backup) reload(source *configSource, sched *scheduler) {
+	rollback, err := source.load(true)
+	if err != nil {
+		logger.Error("failed to reload configuration", zap.Error(err))
+		return
+	}
+	// credentials from the file may have been rotated, old values stay masked
+	// because running commands may still log them
+	registerSecrets()
+	old := b.conf()
+	cfg, err := loadConfig()
+	var restart []string
+	if err == nil {
+		// settings which are ignored until a restart must not reject the reload
+		restart = keepRestartSettings(old, cfg)
+		err = cfg.Validate()
+	}
+	if err != nil {
+		rollback()
+		logger.Error("invalid configuration, keeping the previous one", zap.Error(err))
+		return
+	}
+
+	for _, setting := range restart {
+		logger.Warn("setting changed but requires a restart to take effect", zap.String("setting", setting))
+	}
+	changes := configChanges(old, cfg)
+	if len(changes) == 0 {
+		logger.Info("configuration unchanged")
+		return
+	}
+
+	if cfg.Repository != old.Repository {
+		if err := b.Ensure(); err != nil {
+			rollback()
+			logger.Error("failed to ensure repository, keeping the previous configuration", zap.Error(err))
+			return
+		}
+	}
+	if !reflect.DeepEqual(cfg.Secondaries, old.Secondaries) || cfg.SecondaryMode != old.SecondaryMode {
+		b.ensureSecondaries(cfg)
+	}
+	if cfg.Schedule != old.Schedule || cfg.CronTZ != old.CronTZ || cfg.ScheduleJitter != old.ScheduleJitter {
+		if err := sched.reschedule(cfg); err != nil {
+			rollback()
+			logger.Error("failed to schedule task, keeping the previous configuration", zap.Error(err))
+			return
+		}
+	}
+	secrets.setPatterns(cfg.RedactPatterns...)
+	b.cfg.Store(cfg)
+	logger.Info("configuration reloaded", zap.Strings("changes", changes))
+}
+
+// keepRestartSettings copies the settings which require a restart from the old configuration
+// and returns the names of those which were changed
+func keepRestartSettings(old, cfg *config) []string {
+	var changed []string
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < newValue.NumField(); i++ {
+		name := newValue.Type().Field(i).Tag.Get("envconfig")
+		if !restartSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, name)
+			newValue.Field(i).Set(oldValue.Field(i))
+		}
+	}
+	return changed
+}
+
+// configChanges describes the settings which differ between two configurations,
+// omitting the values of credentials
+func configChanges(old, cfg *config) []string {
+	var changes []string
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < newValue.NumField(); i++ {
+		name := newValue.Type().Field(i).Tag.Get("envconfig")
+		before := fmt.Sprint(oldValue.Field(i).Interface())
+		after := fmt.Sprint(newValue.Field(i).Interface())
+		if before == after {
+			continue
+		}
+		if matchCredentialName.MatchString(name) {
+			changes = append(changes, name+" changed")
+		} else {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", name, before, after))
+		}
+	}
+	return changes
+}
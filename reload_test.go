@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_configSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restic-robot.env")
+	require.NoError(t, os.WriteFile(path, []byte("RR_TEST_SCHEDULE=@daily\nRR_TEST_ARGS=/data\nRR_TEST_OVERRIDDEN=file\n"), 0o600))
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("RR_TEST_OVERRIDDEN", "env")
+	defer os.Unsetenv("RR_TEST_SCHEDULE")
+	defer os.Unsetenv("RR_TEST_ARGS")
+
+	source := newConfigSource()
+	_, err := source.load(false)
+	require.NoError(t, err)
+	assert.Equal(t, "@daily", os.Getenv("RR_TEST_SCHEDULE"))
+	assert.Equal(t, "/data", os.Getenv("RR_TEST_ARGS"))
+	assert.Equal(t, "env", os.Getenv("RR_TEST_OVERRIDDEN"))
+	assert.False(t, source.changed())
+
+	// change one setting and remove another
+	require.NoError(t, os.WriteFile(path, []byte("RR_TEST_SCHEDULE=@hourly\nRR_TEST_OVERRIDDEN=file\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	assert.True(t, source.changed())
+	rollback, err := source.load(true)
+	require.NoError(t, err)
+	assert.Equal(t, "@hourly", os.Getenv("RR_TEST_SCHEDULE"))
+	_, set := os.LookupEnv("RR_TEST_ARGS")
+	assert.False(t, set)
+	assert.Equal(t, "env", os.Getenv("RR_TEST_OVERRIDDEN"))
+
+	// a rejected configuration restores the previous environment
+	rollback()
+	assert.Equal(t, "@daily", os.Getenv("RR_TEST_SCHEDULE"))
+	assert.Equal(t, "/data", os.Getenv("RR_TEST_ARGS"))
+	assert.True(t, source.changed())
+}
+
+func Test_configChanges(t *testing.T) {
+	old := &config{Schedule: "0 0 2 * * *", Args: "/data", Password: "old-secret", PrometheusAddress: ":8080"}
+	cfg := &config{Schedule: "@daily", Args: "/data", Password: "new-secret", PrometheusAddress: ":9090"}
+
+	assert.Equal(t, []string{"PROMETHEUS_ADDRESS"}, keepRestartSettings(old, cfg))
+	assert.Equal(t, ":8080", cfg.PrometheusAddress)
+
+	changes := configChanges(old, cfg)
+	assert.Equal(t, []string{
+		`SCHEDULE: "0 0 2 * * *" -> "@daily"`,
+		"RESTIC_PASSWORD changed",
+	}, changes)
+}
+
+func Test_reloadSecrets(t *testing.T) {
+	previous := secrets
+	secrets = &redactor{}
+	defer func() { secrets = previous }()
+	stubCommands(t)
+	restic := filepath.Join(filepath.Dir(os.Getenv("STUB_LOG")), "restic")
+	require.NoError(t, os.WriteFile(restic, []byte("#!/bin/sh\necho '{\"message_type\":\"version\",\"version\":\"0.17.0\"}'\n"), 0o755))
+
+	path := filepath.Join(t.TempDir(), "restic-robot.env")
+	require.NoError(t, os.WriteFile(path, []byte("AWS_SECRET_ACCESS_KEY=rotated-secret-key\nAWS_ACCESS_KEY_ID=rotated-access-id\n"+
+		"REDACT_PATTERNS=token=(\\w+)\nTLS_CERT_FILE=/does/not/exist.crt\n"), 0o600))
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("SCHEDULE", "@daily")
+	t.Setenv("RESTIC_REPOSITORY", t.TempDir())
+	t.Setenv("RESTIC_PASSWORD", "repository-password")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("REDACT_PATTERNS")
+	defer os.Unsetenv("TLS_CERT_FILE")
+
+	var patterns regexpList
+	require.NoError(t, patterns.Decode("key=(\\w+)"))
+	secrets.setPatterns(patterns...)
+	b := newTestBackup()
+	old := b.conf()
+	old.Schedule = "@daily"
+	old.Repository = os.Getenv("RESTIC_REPOSITORY")
+	old.Password = "repository-password"
+	old.ResticBinary = "restic"
+	old.RedactPatterns = patterns
+
+	// the missing certificate is ignored until a restart instead of rejecting the reload
+	b.reload(newConfigSource(), newScheduler(nil, nil))
+	require.NotEqual(t, old, b.conf(), "configuration was not reloaded")
+	assert.Empty(t, b.conf().TLSCertFile)
+
+	assert.Equal(t, "aws "+redactedValue, secrets.redact("aws rotated-secret-key"))
+	assert.Equal(t, "aws "+redactedValue, secrets.redact("aws rotated-access-id"))
+	// the previous patterns are replaced
+	assert.Equal(t, "token="+redactedValue+" key=abc", secrets.redact("token=abc key=abc"))
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // Restic Types from JSON output: https://restic.readthedocs.io/en/stable/075_scripting.html#json-output
 
 // BackupMessage represents a general message from Restic backup, with a MessageType for type assertion.
@@ -58,9 +60,58 @@ type BackupSummaryMessage struct {
 	SnapshotID          string  `json:"snapshot_id"`
 }
 
+// VersionMessage represents the output of `restic version --json`.
+type VersionMessage struct {
+	MessageType string `json:"message_type"`
+	Version     string `json:"version"`
+	GoVersion   string `json:"go_version"`
+	GoOS        string `json:"go_os"`
+	GoArch      string `json:"go_arch"`
+}
+
 // InitMessage represents the summary of `restic init`.
 type InitMessage struct {
 	MessageType string `json:"message_type"`
 	ID          string `json:"id"`
 	Repository  string `json:"repository"`
 }
+
+// Snapshot represents a single entry of `restic snapshots --json`.
+type Snapshot struct {
+	ID             string    `json:"id"`
+	ShortID        string    `json:"short_id"`
+	Time           time.Time `json:"time"`
+	Parent         string    `json:"parent,omitempty"`
+	Tree           string    `json:"tree"`
+	Paths          []string  `json:"paths"`
+	Hostname       string    `json:"hostname"`
+	Username       string    `json:"username"`
+	Tags           []string  `json:"tags,omitempty"`
+	ProgramVersion string    `json:"program_version,omitempty"`
+}
+
+// LsNode represents a file or directory printed by `restic ls --json` and `restic find --json`.
+type LsNode struct {
+	StructType  string    `json:"struct_type,omitempty"`
+	MessageType string    `json:"message_type,omitempty"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Path        string    `json:"path"`
+	Size        uint64    `json:"size,omitempty"`
+	Permissions string    `json:"permissions,omitempty"`
+	ModTime     time.Time `json:"mtime"`
+}
+
+// FindResult represents the matches of `restic find --json` within a single snapshot.
+type FindResult struct {
+	Matches  []LsNode `json:"matches"`
+	Hits     int      `json:"hits"`
+	Snapshot string   `json:"snapshot"`
+}
+
+// RepositoryStats represents the output of `restic stats --json`.
+type RepositoryStats struct {
+	TotalSize      uint64 `json:"total_size"`
+	TotalFileCount uint64 `json:"total_file_count"`
+	SnapshotsCount int    `json:"snapshots_count"`
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// resticBinary is the restic executable, set from RESTIC_BINARY at startup
+var resticBinary = "restic"
+
+// resticRunner invokes restic subcommands, the arguments are appended to the ones each
+// method passes itself. An env replaces the environment of restic, nil inherits it.
+// Tests replace it with a scripted fake.
+type resticRunner interface {
+	init(ctx context.Context, env []string, args ...string) (InitMessage, error)
+	backup(ctx context.Context, req backupRequest) (backupOutput, error)
+	copy(ctx context.Context, env []string, args ...string) error
+	forget(ctx context.Context, args ...string) ([]byte, error)
+	check(ctx context.Context, args ...string) error
+	snapshots(ctx context.Context, args ...string) ([]Snapshot, error)
+	ls(ctx context.Context, args ...string) ([]LsNode, error)
+	find(ctx context.Context, args ...string) ([]FindResult, error)
+	stats(ctx context.Context, args ...string) (RepositoryStats, error)
+	unlock(ctx context.Context, args ...string) error
+	// probe checks that the repository is reachable without locking it
+	probe(ctx context.Context) error
+}
+
+// backupRequest describes a run of `restic backup`
+type backupRequest struct {
+	// args are the arguments of the backup command, starting with "backup"
+	args     []string
+	throttle throttle
+	// source produces the data read from stdin, nil when backing up files
+	source *exec.Cmd
+	// snapshot is mounted over snapshotSource while restic runs, empty for the live filesystem
+	snapshot       string
+	snapshotSource string
+	// env replaces the environment of restic, nil to inherit it
+	env []string
+}
+
+// backupOutput is what `restic backup` produced
+type backupOutput struct {
+	stdout []byte
+	stderr string
+	// source is the outcome of the source command, nil if there was none
+	source *sourceResult
+}
+
+// execRunner runs the restic binary
+type execRunner struct{}
+
+func (execRunner) init(ctx context.Context, env []string, args ...string) (InitMessage, error) {
+	var msg InitMessage
+	out, err := resticOutput(ctx, env, append([]string{"init", "--json"}, args...)...)
+	if err != nil {
+		return msg, err
+	}
+	return msg, errors.Wrap(json.Unmarshal(out, &msg), "parsing JSON output")
+}
+
+func (execRunner) backup(ctx context.Context, req backupRequest) (backupOutput, error) {
+	cmd := resticCommand(ctx, append(req.throttle.args(), req.args...)...)
+	if req.env != nil {
+		cmd.Env = req.env
+	}
+	prioritize(cmd, req.throttle)
+	if req.snapshot != "" {
+		bindSnapshot(cmd, req.snapshot, req.snapshotSource)
+	}
+	outbuf := bytes.NewBuffer(nil)
+	errbuf := bytes.NewBuffer(nil)
+	cmd.Stdout = outbuf
+	cmd.Stderr = errbuf
+	source, err := runWithSource(cmd, req.source)
+	return backupOutput{stdout: outbuf.Bytes(), stderr: errbuf.String(), source: source}, err
+}
+
+func (execRunner) copy(ctx context.Context, env []string, args ...string) error {
+	_, err := resticOutput(ctx, env, append([]string{"copy"}, args...)...)
+	return err
+}
+
+func (execRunner) forget(ctx context.Context, args ...string) ([]byte, error) {
+	return resticOutput(ctx, nil, append([]string{"forget", "--json"}, args...)...)
+}
+
+func (execRunner) check(ctx context.Context, args ...string) error {
+	_, err := resticOutput(ctx, nil, append([]string{"check"}, args...)...)
+	return err
+}
+
+func (execRunner) snapshots(ctx context.Context, args ...string) ([]Snapshot, error) {
+	out, err := resticOutput(ctx, nil, append([]string{"snapshots", "--json"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	return snapshots, errors.Wrap(json.Unmarshal(out, &snapshots), "parsing snapshots")
+}
+
+func (execRunner) ls(ctx context.Context, args ...string) ([]LsNode, error) {
+	out, err := resticOutput(ctx, nil, append([]string{"ls", "--json"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseLsOutput(out)
+}
+
+func (execRunner) find(ctx context.Context, args ...string) ([]FindResult, error) {
+	out, err := resticOutput(ctx, nil, append([]string{"find", "--json"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var results []FindResult
+	return results, errors.Wrap(json.Unmarshal(out, &results), "parsing find results")
+}
+
+func (execRunner) stats(ctx context.Context, args ...string) (RepositoryStats, error) {
+	var stats RepositoryStats
+	out, err := resticOutput(ctx, nil, append([]string{"stats", "--json"}, args...)...)
+	if err != nil {
+		return stats, err
+	}
+	return stats, errors.Wrap(json.Unmarshal(out, &stats), "parsing stats")
+}
+
+func (execRunner) unlock(ctx context.Context, args ...string) error {
+	_, err := resticOutput(ctx, nil, append([]string{"unlock"}, args...)...)
+	return err
+}
+
+func (execRunner) probe(ctx context.Context) error {
+	_, err := resticOutput(ctx, nil, "--no-lock", "cat", "config")
+	return err
+}
+
+// resticOutput runs restic and returns its standard output, errors include its standard error
+func resticOutput(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	cmd := resticCommand(ctx, args...)
+	if env != nil {
+		cmd.Env = env
+	}
+	errbuf := bytes.NewBuffer(nil)
+	cmd.Stderr = errbuf
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, strings.TrimSpace(errbuf.String()))
+	}
+	return out, nil
+}
+
+// runner returns the runner invoking restic
+func (b *backup) runner() resticRunner {
+	if b.restic == nil {
+		return execRunner{}
+	}
+	return b.restic
+}
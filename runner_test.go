@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRunner is a scripted resticRunner which records its invocations
+type fakeRunner struct {
+	mu    sync.Mutex
+	calls []string
+	// requests are the backup requests received
+	requests []backupRequest
+	// envs are the environments passed to init and copy
+	envs [][]string
+	// script holds the results by subcommand, subcommands without one succeed without output
+	script map[string]fakeResult
+}
+
+// fakeResult is the scripted result of a subcommand
+type fakeResult struct {
+	output []byte
+	err    error
+	// block makes backups wait until their context is done and fail with its error
+	block bool
+}
+
+// call records an invocation and returns its scripted result
+func (f *fakeRunner) call(args ...string) fakeResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, strings.Join(args, " "))
+	return f.script[args[0]]
+}
+
+// callWithEnv records an invocation together with its environment
+func (f *fakeRunner) callWithEnv(env []string, args ...string) fakeResult {
+	f.mu.Lock()
+	f.envs = append(f.envs, env)
+	f.mu.Unlock()
+	return f.call(args...)
+}
+
+func (f *fakeRunner) init(_ context.Context, env []string, args ...string) (InitMessage, error) {
+	var msg InitMessage
+	res := f.callWithEnv(env, append([]string{"init"}, args...)...)
+	if res.err != nil {
+		return msg, res.err
+	}
+	return msg, json.Unmarshal(res.output, &msg)
+}
+
+func (f *fakeRunner) backup(ctx context.Context, req backupRequest) (backupOutput, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	res := f.call(req.args...)
+	if res.block {
+		<-ctx.Done()
+		return backupOutput{}, ctx.Err()
+	}
+	return backupOutput{stdout: res.output}, res.err
+}
+
+// invocations returns the recorded invocations
+func (f *fakeRunner) invocations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func (f *fakeRunner) copy(_ context.Context, env []string, args ...string) error {
+	return f.callWithEnv(env, append([]string{"copy"}, args...)...).err
+}
+
+func (f *fakeRunner) forget(_ context.Context, args ...string) ([]byte, error) {
+	res := f.call(append([]string{"forget"}, args...)...)
+	return res.output, res.err
+}
+
+func (f *fakeRunner) check(_ context.Context, args ...string) error {
+	return f.call(append([]string{"check"}, args...)...).err
+}
+
+func (f *fakeRunner) snapshots(_ context.Context, args ...string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	res := f.call(append([]string{"snapshots"}, args...)...)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return snapshots, json.Unmarshal(res.output, &snapshots)
+}
+
+func (f *fakeRunner) ls(_ context.Context, args ...string) ([]LsNode, error) {
+	res := f.call(append([]string{"ls"}, args...)...)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return parseLsOutput(res.output)
+}
+
+func (f *fakeRunner) find(_ context.Context, args ...string) ([]FindResult, error) {
+	var results []FindResult
+	res := f.call(append([]string{"find"}, args...)...)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return results, json.Unmarshal(res.output, &results)
+}
+
+func (f *fakeRunner) stats(_ context.Context, args ...string) (RepositoryStats, error) {
+	var stats RepositoryStats
+	res := f.call(append([]string{"stats"}, args...)...)
+	if res.err != nil {
+		return stats, res.err
+	}
+	return stats, json.Unmarshal(res.output, &stats)
+}
+
+func (f *fakeRunner) unlock(_ context.Context, args ...string) error {
+	return f.call(append([]string{"unlock"}, args...)...).err
+}
+
+func (f *fakeRunner) probe(_ context.Context) error {
+	return f.call("probe").err
+}
+
+func Test_Ensure(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  fakeResult
+		wantErr bool
+	}{
+		{"created", fakeResult{output: []byte(`{"message_type":"initialized","id":"1a2b","repository":"/srv"}`)}, false},
+		{"exists", fakeResult{err: errors.New("Fatal: create repository at /srv failed: config file already exists")}, false},
+		{"fails", fakeResult{err: errors.New("Fatal: unable to open repository")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeRunner{script: map[string]fakeResult{"init": tt.result}}
+			b := newTestBackup()
+			b.restic = fake
+			err := b.Ensure()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, []string{"init"}, fake.calls)
+		})
+	}
+}
+
+func Test_lastRunFromSnapshots(t *testing.T) {
+	fake := &fakeRunner{script: map[string]fakeResult{
+		"snapshots": {output: []byte(`[{"id":"1a2b","time":"2024-05-01T03:00:00Z"}]`)},
+	}}
+	b := newTestBackup()
+	b.restic = fake
+
+	last, err := b.lastRun(b.conf())
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), last.UTC())
+	require.Len(t, fake.calls, 1)
+	assert.True(t, strings.HasPrefix(fake.calls[0], "snapshots --latest 1 --host "))
+}
+
+func Test_loadLastSuccess(t *testing.T) {
+	fake := &fakeRunner{script: map[string]fakeResult{
+		"snapshots": {output: []byte(`[{"id":"1a2b","time":"2024-05-01T03:00:00Z"}]`)},
+	}}
+	b := newTestBackup()
+	b.restic = fake
+
+	// without a state file, the latest snapshot is the last success
+	b.loadLastSuccess(b.conf())
+	last, ok := b.lastBackup()
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), last.UTC())
+
+	// runs of discovered jobs don't count as successful backups
+	fake.script["backup"] = fakeResult{output: []byte(summaryOutput + "\n")}
+	r := newRun(triggerSchedule, runOptions{Paths: []string{"/data/db"}})
+	r.setJob("db", b.conf())
+	b.execute(r)
+	assert.Equal(t, runStatusSucceeded, r.Result().Status)
+	last, _ = b.lastBackup()
+	assert.Equal(t, time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), last.UTC())
+}
+
+func Test_executeWithFakeRunner(t *testing.T) {
+	fake := &fakeRunner{script: map[string]fakeResult{"backup": {output: []byte(summaryOutput + "\n")}}}
+	b := newTestBackup()
+	b.restic = fake
+	cfg := b.conf()
+	cfg.Repository = "/srv/primary"
+	cfg.LimitUpload = 512
+	cfg.SecondaryMode = secondaryBackup
+	cfg.Secondaries = repositoryList{{name: "offsite", repository: "/mnt/offsite"}}
+
+	r := newRun(triggerManual, runOptions{Tags: []string{"manual"}, Paths: []string{"/data"}})
+	b.execute(r)
+
+	result := r.Result()
+	assert.Equal(t, runStatusSucceeded, result.Status)
+	assert.Equal(t, "1a2b3c", result.SnapshotID)
+	assert.Equal(t, []secondaryResult{{Name: "offsite", Status: runStatusSucceeded, SnapshotID: "1a2b3c"}}, result.Secondaries)
+	assert.Equal(t, []string{
+		"backup --json --tag manual /data",
+		"backup --json --tag manual /data",
+	}, fake.calls)
+	// the primary inherits the environment, the secondary is pointed at its repository
+	require.Len(t, fake.requests, 2)
+	assert.Equal(t, 512, fake.requests[0].throttle.limitUpload)
+	assert.Nil(t, fake.requests[0].env)
+	assert.Contains(t, fake.requests[1].env, "RESTIC_REPOSITORY=/mnt/offsite")
+}
+
+func Test_executeSecondariesAfterFailure(t *testing.T) {
+	fake := &fakeRunner{script: map[string]fakeResult{"backup": {err: errors.New("repository locked")}}}
+	b := newTestBackup()
+	b.restic = fake
+	cfg := b.conf()
+	cfg.SecondaryMode = secondaryBackup
+	cfg.Secondaries = repositoryList{{name: "offsite", repository: "/mnt/offsite"}}
+
+	r := newRun(triggerManual, runOptions{})
+	b.execute(r)
+
+	// secondaries are only updated after a successful backup to the primary
+	assert.Equal(t, runStatusFailed, r.Result().Status)
+	assert.Len(t, fake.calls, 1)
+	assert.Empty(t, r.Result().Secondaries)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// triggerSchedule marks runs started by the cron schedule
+	triggerSchedule = "schedule"
+	// triggerBoot marks runs started because of RUN_ON_BOOT
+	triggerBoot = "boot"
+	// triggerManual marks runs started through the trigger endpoint
+	triggerManual = "manual"
+
+	// runStatusDeferred indicates the run waits for backups to be allowed again
+	runStatusDeferred = "deferred"
+	// runStatusQueued indicates the run waits for another backup to complete
+	runStatusQueued = "queued"
+	// runStatusRunning indicates the run is in progress
+	runStatusRunning = "running"
+	// runStatusSucceeded indicates the run completed successfully
+	runStatusSucceeded = "succeeded"
+	// runStatusFailed indicates the run failed
+	runStatusFailed = "failed"
+
+	// runHistorySize is the number of runs kept for lookups by ID
+	runHistorySize = 100
+)
+
+// runResult is the externally visible state of a run
+type runResult struct {
+	ID              string            `json:"id"`
+	Job             string            `json:"job,omitempty"`
+	Trigger         string            `json:"trigger"`
+	Options         *runOptions       `json:"options,omitempty"`
+	Status          string            `json:"status"`
+	Started         time.Time         `json:"started"`
+	DeferredUntil   *time.Time        `json:"deferred_until,omitempty"`
+	Finished        *time.Time        `json:"finished,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Warnings        []string          `json:"warnings,omitempty"`
+	Phases          map[string]string `json:"phases,omitempty"`
+	SnapshotID      string            `json:"snapshot_id,omitempty"`
+	Stats           *stats            `json:"stats,omitempty"`
+	Source          *sourceResult     `json:"source,omitempty"`
+	Secondaries     []secondaryResult `json:"secondaries,omitempty"`
+}
+
+// run is a single backup execution
+type run struct {
+	mu     sync.Mutex
+	result runResult
+	// options are the overrides requested for this run
+	options runOptions
+	// cfg replaces the global configuration for runs of discovered jobs
+	cfg *config
+	// done is closed once the run has finished
+	done chan struct{}
+}
+
+// newRun creates a run with a random ID
+func newRun(trigger string, opts runOptions) *run {
+	r := &run{
+		options: opts,
+		result: runResult{
+			ID:      newRunID(),
+			Trigger: trigger,
+			Status:  runStatusRunning,
+			Started: time.Now(),
+		},
+		done: make(chan struct{}),
+	}
+	if !opts.empty() {
+		r.result.Options = &r.options
+	}
+	return r
+}
+
+// newRunID returns a random identifier for a run
+func newRunID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// ID returns the identifier of the run
+func (r *run) ID() string {
+	return r.result.ID
+}
+
+// Result returns a copy of the current state of the run
+func (r *run) Result() runResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.result
+}
+
+// setJob marks the run as belonging to a discovered job with its own configuration
+func (r *run) setJob(name string, cfg *config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result.Job = name
+	r.cfg = cfg
+}
+
+// setStatus updates the status of a pending run, resetting its start time once it runs
+func (r *run) setStatus(status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result.Status = status
+	if status == runStatusRunning {
+		r.result.Started = time.Now()
+	}
+}
+
+// setDeferred marks the run as held back until the given time
+func (r *run) setDeferred(until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result.Status = runStatusDeferred
+	r.result.DeferredUntil = &until
+}
+
+// setSource records the outcome of the command producing the data of the run
+func (r *run) setSource(source *sourceResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result.Source = source
+}
+
+// addSecondary records the outcome for a secondary repository
+func (r *run) addSecondary(result secondaryResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result.Secondaries = append(r.result.Secondaries, result)
+}
+
+// setPhases records the outcome of each phase and the failures which didn't fail the run
+func (r *run) setPhases(phases map[string]string, warnings []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result.Phases = phases
+	r.result.Warnings = warnings
+}
+
+// finish records the outcome of the run and wakes up everyone waiting for it
+func (r *run) finish(err error, statistics *stats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.result.Finished = &now
+	r.result.DurationSeconds = now.Sub(r.result.Started).Seconds()
+	if err != nil {
+		r.result.Status = runStatusFailed
+		r.result.Error = secrets.redact(err.Error())
+	} else {
+		r.result.Status = runStatusSucceeded
+	}
+	if statistics != nil {
+		r.result.SnapshotID = statistics.snapshotID
+		r.result.Stats = statistics
+	}
+	close(r.done)
+}
+
+// runHistory keeps the most recent runs for lookups by ID
+type runHistory struct {
+	mu    sync.Mutex
+	runs  map[string]*run
+	order []string
+}
+
+// add registers a run, evicting the oldest one if the history is full
+func (h *runHistory) add(r *run) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.runs == nil {
+		h.runs = make(map[string]*run)
+	}
+	h.runs[r.ID()] = r
+	h.order = append(h.order, r.ID())
+	if len(h.order) > runHistorySize {
+		delete(h.runs, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+// get returns the run with the given ID, or nil if it is unknown
+func (h *runHistory) get(id string) *run {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.runs[id]
+}
+
+// MarshalJSON renders the statistics of a run for API responses
+func (s stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		FilesNew        int   `json:"files_new"`
+		FilesChanged    int   `json:"files_changed"`
+		FilesUnmodified int   `json:"files_unmodified"`
+		FilesProcessed  int   `json:"files_processed"`
+		BytesAdded      int64 `json:"bytes_added"`
+		BytesProcessed  int64 `json:"bytes_processed"`
+	}{
+		FilesNew:        s.filesNew,
+		FilesChanged:    s.filesChanged,
+		FilesUnmodified: s.filesUnmodified,
+		FilesProcessed:  s.filesProcessed,
+		BytesAdded:      s.bytesAdded,
+		BytesProcessed:  s.bytesProcessed,
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+	// time zone database for CRON_TZ and TZ in minimal container images
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// scheduleParser accepts standard 5-field expressions, descriptors like @daily or @every 6h,
+// and the 6-field expressions with leading seconds used by earlier versions
+var scheduleParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// parseSchedule parses the cron schedule in the configured time zone
+func (c *config) parseSchedule() (cron.Schedule, error) {
+	spec := strings.TrimSpace(c.Schedule)
+	if c.CronTZ != "" && !strings.HasPrefix(spec, "TZ=") && !strings.HasPrefix(spec, "CRON_TZ=") {
+		spec = "CRON_TZ=" + c.CronTZ + " " + spec
+	}
+	return scheduleParser.Parse(spec)
+}
+
+// scheduler runs a job on a cron schedule which can be replaced at runtime
+type scheduler struct {
+	job cron.Job
+	// onNext is called with the next scheduled run whenever it changes
+	onNext func(time.Time)
+
+	mu       sync.Mutex
+	cron     *cron.Cron
+	entry    cron.EntryID
+	schedule cron.Schedule
+}
+
+// newScheduler creates a scheduler for the given job
+func newScheduler(job cron.Job, onNext func(time.Time)) *scheduler {
+	return &scheduler{
+		job:    job,
+		onNext: onNext,
+		cron:   cron.New(cron.WithParser(scheduleParser)),
+	}
+}
+
+// reschedule replaces the current schedule, leaving runs in progress untouched
+func (s *scheduler) reschedule(cfg *config) error {
+	schedule, err := cfg.parseSchedule()
+	if err != nil {
+		return err
+	}
+	jitter := cfg.ScheduleJitter
+	job := cron.FuncJob(func() {
+		s.publishNext()
+		if jitter > 0 {
+			// spread the start of backups sharing the same storage
+			delay := time.Duration(rand.Int63n(int64(jitter)))
+			logger.Debug("delaying scheduled backup", zap.Duration("jitter", delay))
+			time.Sleep(delay)
+		}
+		s.job.Run()
+	})
+
+	s.mu.Lock()
+	if s.entry != 0 {
+		s.cron.Remove(s.entry)
+	}
+	s.entry = s.cron.Schedule(schedule, job)
+	s.schedule = schedule
+	s.mu.Unlock()
+
+	s.publishNext()
+	return nil
+}
+
+// next returns the time of the next scheduled run
+func (s *scheduler) next() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schedule == nil {
+		return time.Time{}
+	}
+	return s.schedule.Next(time.Now())
+}
+
+// publishNext reports the next scheduled run
+func (s *scheduler) publishNext() {
+	if s.onNext != nil {
+		s.onNext(s.next())
+	}
+}
+
+// start begins running the job on its schedule
+func (s *scheduler) start() {
+	s.cron.Start()
+}
+
+// stop ends scheduling runs, runs in progress are not affected
+func (s *scheduler) stop() {
+	s.cron.Stop()
+}
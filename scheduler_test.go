@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSchedule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		schedule string
+		tz       string
+		want     time.Time
+	}{
+		{"0 2 * * *", "", time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC)},
+		{"0 0 2 * * *", "", time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC)},
+		{"@daily", "", time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"@every 6h", "", now.Add(6 * time.Hour)},
+		{"0 2 * * *", "Europe/Berlin", time.Date(2024, 3, 2, 2, 0, 0, 0, berlin)},
+		{"CRON_TZ=UTC 0 2 * * *", "Europe/Berlin", time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule+" "+tt.tz, func(t *testing.T) {
+			schedule, err := (&config{Schedule: tt.schedule, CronTZ: tt.tz}).parseSchedule()
+			require.NoError(t, err)
+			assert.True(t, tt.want.Equal(schedule.Next(now)), "got %v", schedule.Next(now))
+		})
+	}
+
+	_, err = (&config{Schedule: "every night"}).parseSchedule()
+	assert.Error(t, err)
+}
+
+func Test_schedulerReschedule(t *testing.T) {
+	var published []time.Time
+	s := newScheduler(cron.FuncJob(func() {}), func(next time.Time) {
+		published = append(published, next)
+	})
+	require.NoError(t, s.reschedule(&config{Schedule: "@hourly"}))
+	require.NoError(t, s.reschedule(&config{Schedule: "@daily"}))
+	assert.Error(t, s.reschedule(&config{Schedule: "invalid"}))
+
+	// the previous entry is replaced rather than added to
+	assert.Len(t, s.cron.Entries(), 1)
+	assert.Len(t, published, 2)
+	assert.Equal(t, published[1], s.next())
+	assert.True(t, s.next().After(time.Now()))
+}
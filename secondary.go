@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// secondaryCopy copies each new snapshot from the primary repository with `restic copy`
+	secondaryCopy = "copy"
+	// secondaryBackup backs up to each secondary repository separately
+	secondaryBackup = "backup"
+
+	// primaryRepository is the repository label of RESTIC_REPOSITORY in metrics
+	primaryRepository = "primary"
+)
+
+var (
+	// matchRepositoryName matches names of secondary repositories
+	matchRepositoryName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// resticRepositoryVariables point restic at a repository and are replaced for secondary repositories
+	resticRepositoryVariables = []string{
+		"RESTIC_REPOSITORY", "RESTIC_REPOSITORY_FILE",
+		"RESTIC_PASSWORD", "RESTIC_PASSWORD_FILE", "RESTIC_PASSWORD_COMMAND",
+		"RESTIC_FROM_REPOSITORY", "RESTIC_FROM_REPOSITORY_FILE",
+		"RESTIC_FROM_PASSWORD", "RESTIC_FROM_PASSWORD_FILE", "RESTIC_FROM_PASSWORD_COMMAND",
+	}
+)
+
+// secondaryRepository is an additional repository backups are copied or written to
+type secondaryRepository struct {
+	name       string
+	repository string
+}
+
+// repositoryList is a semicolon-separated list of name=repository pairs read from the environment
+type repositoryList []secondaryRepository
+
+// Decode implements envconfig.Decoder
+func (l *repositoryList) Decode(value string) error {
+	*l = nil
+	names := make(map[string]bool)
+	for _, pair := range strings.Split(value, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, repository, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || repository == "" {
+			return errors.Errorf("invalid repository %q, must be name=repository", pair)
+		}
+		if !matchRepositoryName.MatchString(name) || name == primaryRepository {
+			return errors.Errorf("invalid repository name %q", name)
+		}
+		if names[name] {
+			return errors.Errorf("duplicate repository name %q", name)
+		}
+		names[name] = true
+		*l = append(*l, secondaryRepository{name: name, repository: repository})
+	}
+	return nil
+}
+
+// String returns the names of the repositories, the locations may contain credentials
+func (l repositoryList) String() string {
+	names := make([]string, len(l))
+	for i, repo := range l {
+		names[i] = repo.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// secondaryResult is the outcome of a run for a secondary repository
+type secondaryResult struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+}
+
+// secondaryEnv returns the environment of restic commands writing to a secondary repository,
+// with the primary repository as the source of copies
+func (c *config) secondaryEnv(repo secondaryRepository) []string {
+	var env []string
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if !contains(resticRepositoryVariables, name) {
+			env = append(env, variable)
+		}
+	}
+	password := c.SecondaryPassword
+	if password == "" {
+		password = c.Password
+	}
+	return append(env,
+		"RESTIC_REPOSITORY="+repo.repository,
+		"RESTIC_PASSWORD="+password,
+		"RESTIC_FROM_REPOSITORY="+c.Repository,
+		"RESTIC_FROM_PASSWORD="+c.Password,
+	)
+}
+
+// contains returns true if the list contains the value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureSecondaries creates the secondary repositories which don't exist yet. In copy mode,
+// they use the chunker parameters of the primary so that copied data deduplicates.
+func (b *backup) ensureSecondaries(cfg *config) {
+	for _, repo := range cfg.Secondaries {
+		var args []string
+		if cfg.SecondaryMode == secondaryCopy {
+			args = append(args, "--copy-chunker-params")
+		}
+		_, err := b.runner().init(context.Background(), cfg.secondaryEnv(repo), args...)
+		switch {
+		case err == nil:
+			logger.Info("successfully created repository", zap.String("repository", repo.name))
+		case matchExists.MatchString(err.Error()):
+			logger.Info("repository exists", zap.String("repository", repo.name))
+		default:
+			// the primary keeps being backed up, runs report the failure of the secondary
+			logger.Error("failed to initialize repository", zap.String("repository", repo.name), zap.Error(err))
+		}
+	}
+}
+
+// copySecondaries copies a snapshot of the primary repository to all secondary repositories,
+// a failure of one does not affect the others. If the ID of the snapshot is unknown, all of
+// them fail.
+func (b *backup) copySecondaries(cfg *config, r *run, snapshotID string) {
+	for _, repo := range cfg.Secondaries {
+		if snapshotID == "" {
+			// without an ID, restic would copy all snapshots of the primary
+			b.finishSecondary(r, repo, errors.New("snapshot ID unknown, nothing copied"), "")
+			continue
+		}
+		err := b.runner().copy(b.ctx, cfg.secondaryEnv(repo), snapshotID)
+		b.finishSecondary(r, repo, err, "")
+	}
+}
+
+// backupSecondaries backs up to all secondary repositories like to the primary one,
+// a failure of one does not affect the others
+func (b *backup) backupSecondaries(cfg *config, r *run, snapshot string, th throttle) {
+	for _, repo := range cfg.Secondaries {
+		out, err := b.runner().backup(b.ctx, backupRequest{
+			args:           cfg.backupArgs(r.options),
+			throttle:       th,
+			snapshot:       snapshot,
+			snapshotSource: cfg.SnapshotSource,
+			env:            cfg.secondaryEnv(repo),
+		})
+		if err != nil {
+			err = errors.Wrap(err, strings.TrimSpace(out.stderr))
+		}
+		var snapshotID string
+		if err == nil {
+			snapshotID = summarySnapshotID(out.stdout)
+		}
+		b.finishSecondary(r, repo, err, snapshotID)
+	}
+}
+
+// summarySnapshotID returns the ID of the snapshot from the JSON output of `restic backup`
+func summarySnapshotID(output []byte) string {
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		var summary BackupSummaryMessage
+		if json.Unmarshal(line, &summary) == nil && summary.MessageType == "summary" {
+			return summary.SnapshotID
+		}
+	}
+	return ""
+}
+
+// finishSecondary records the outcome for a secondary repository
+func (b *backup) finishSecondary(r *run, repo secondaryRepository, err error, snapshotID string) {
+	result := secondaryResult{Name: repo.name, Status: runStatusSucceeded, SnapshotID: snapshotID}
+	if err != nil {
+		result.Status = runStatusFailed
+		result.Error = secrets.redact(err.Error())
+		logger.Error("failed to update secondary repository", zap.String("repository", repo.name), zap.Error(err))
+	} else {
+		logger.Info("secondary repository updated", zap.String("repository", repo.name))
+	}
+	r.addSecondary(result)
+	b.recordRepository(repo.name, err == nil)
+}
+
+// recordRepository updates the metrics of a repository
+func (b *backup) recordRepository(name string, success bool) {
+	if success {
+		b.repositoryRuns.WithLabelValues(name, runStatusSucceeded).Inc()
+		b.repositoryTimestamp.WithLabelValues(name).Set(float64(time.Now().Unix()))
+	} else {
+		b.repositoryRuns.WithLabelValues(name, runStatusFailed).Inc()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resticStub logs the repository and arguments of each invocation and fails for the
+// repository in $STUB_FAIL
+const resticStub = `#!/bin/sh
+echo "$RESTIC_REPOSITORY $*" >> "$STUB_LOG"
+if [ "$RESTIC_REPOSITORY" = "$STUB_FAIL" ]; then echo "repository locked" >&2; exit 1; fi
+case " $* " in *" backup "*) echo '{"message_type":"summary","snapshot_id":"'"$RESTIC_REPOSITORY"'-id"}';; esac
+`
+
+func Test_repositoryListDecode(t *testing.T) {
+	var l repositoryList
+	require.NoError(t, l.Decode("offsite=s3:s3.amazonaws.com/bucket; local=/mnt/backup ;"))
+	assert.Equal(t, repositoryList{
+		{name: "offsite", repository: "s3:s3.amazonaws.com/bucket"},
+		{name: "local", repository: "/mnt/backup"},
+	}, l)
+	assert.Equal(t, "offsite, local", l.String())
+
+	for _, value := range []string{
+		"/mnt/backup",
+		"offsite=",
+		"primary=/mnt/backup",
+		"off site=/mnt/backup",
+		"a=/mnt/a;a=/mnt/b",
+	} {
+		assert.Error(t, l.Decode(value), value)
+	}
+}
+
+func Test_secondaryEnv(t *testing.T) {
+	t.Setenv("RESTIC_PASSWORD_FILE", "/run/secrets/password")
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	cfg := &config{Repository: "/srv/primary", Password: "primary"}
+	repo := secondaryRepository{name: "local", repository: "/mnt/backup"}
+
+	env := cfg.secondaryEnv(repo)
+	assert.Contains(t, env, "AWS_ACCESS_KEY_ID=key")
+	assert.Contains(t, env, "RESTIC_REPOSITORY=/mnt/backup")
+	assert.Contains(t, env, "RESTIC_PASSWORD=primary")
+	assert.Contains(t, env, "RESTIC_FROM_REPOSITORY=/srv/primary")
+	assert.Contains(t, env, "RESTIC_FROM_PASSWORD=primary")
+	assert.NotContains(t, env, "RESTIC_PASSWORD_FILE=/run/secrets/password")
+
+	cfg.SecondaryPassword = "secondary"
+	assert.Contains(t, cfg.secondaryEnv(repo), "RESTIC_PASSWORD=secondary")
+}
+
+// stubRestic puts resticStub first in PATH and returns a function reading the logged invocations
+func stubRestic(t *testing.T) func() []string {
+	calls := stubCommands(t)
+	dir := filepath.Dir(os.Getenv("STUB_LOG"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "restic"), []byte(resticStub), 0o755))
+	return calls
+}
+
+func Test_copySecondaries(t *testing.T) {
+	calls := stubRestic(t)
+	t.Setenv("STUB_FAIL", "/mnt/a")
+	b := newTestBackup()
+	cfg := &config{Repository: "/srv/primary", Secondaries: repositoryList{
+		{name: "a", repository: "/mnt/a"},
+		{name: "b", repository: "/mnt/b"},
+	}}
+	r := newRun(triggerManual, runOptions{})
+
+	b.copySecondaries(cfg, r, "abcdef")
+	assert.Equal(t, []string{"/mnt/a copy abcdef", "/mnt/b copy abcdef"}, calls())
+
+	// a failing repository does not keep the others from being updated
+	secondaries := r.Result().Secondaries
+	require.Len(t, secondaries, 2)
+	assert.Equal(t, runStatusFailed, secondaries[0].Status)
+	assert.Contains(t, secondaries[0].Error, "repository locked")
+	assert.Equal(t, secondaryResult{Name: "b", Status: runStatusSucceeded}, secondaries[1])
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.repositoryRuns.WithLabelValues("a", runStatusFailed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.repositoryRuns.WithLabelValues("b", runStatusSucceeded)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.repositoryTimestamp.WithLabelValues("a")))
+	assert.NotZero(t, testutil.ToFloat64(b.repositoryTimestamp.WithLabelValues("b")))
+}
+
+func Test_copySecondariesUnknownSnapshot(t *testing.T) {
+	fake := &fakeRunner{}
+	b := newTestBackup()
+	b.restic = fake
+	cfg := &config{Repository: "/srv/primary", Secondaries: repositoryList{{name: "a", repository: "/mnt/a"}}}
+	r := newRun(triggerManual, runOptions{})
+
+	b.copySecondaries(cfg, r, "")
+	assert.Empty(t, fake.calls)
+	secondaries := r.Result().Secondaries
+	require.Len(t, secondaries, 1)
+	assert.Equal(t, runStatusFailed, secondaries[0].Status)
+	assert.Contains(t, secondaries[0].Error, "snapshot ID unknown")
+}
+
+func Test_ensureSecondaries(t *testing.T) {
+	fake := &fakeRunner{script: map[string]fakeResult{"init": {err: errors.New("config file already exists")}}}
+	b := newTestBackup()
+	b.restic = fake
+	cfg := &config{Repository: "/srv/primary", SecondaryMode: secondaryCopy, Secondaries: repositoryList{
+		{name: "a", repository: "/mnt/a"},
+	}}
+
+	b.ensureSecondaries(cfg)
+	r := newRun(triggerManual, runOptions{})
+	b.copySecondaries(cfg, r, "abcdef")
+	assert.Equal(t, []string{"init --copy-chunker-params", "copy abcdef"}, fake.calls)
+	require.Len(t, fake.envs, 2)
+	for _, env := range fake.envs {
+		assert.Contains(t, env, "RESTIC_REPOSITORY=/mnt/a")
+		assert.Contains(t, env, "RESTIC_FROM_REPOSITORY=/srv/primary")
+	}
+}
+
+func Test_backupSecondaries(t *testing.T) {
+	calls := stubRestic(t)
+	b := newTestBackup()
+	cfg := &config{Repository: "/srv/primary", Secondaries: repositoryList{
+		{name: "a", repository: "/mnt/a"},
+	}}
+	r := newRun(triggerManual, runOptions{Paths: []string{"/data"}})
+
+	b.backupSecondaries(cfg, r, "", throttle{limitUpload: 100})
+	assert.Equal(t, []string{"/mnt/a --limit-upload 100 backup --json /data"}, calls())
+	assert.Equal(t, []secondaryResult{{Name: "a", Status: runStatusSucceeded, SnapshotID: "/mnt/a-id"}},
+		r.Result().Secondaries)
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.repositoryRuns.WithLabelValues("a", runStatusSucceeded)))
+}
+
+func Test_summarySnapshotID(t *testing.T) {
+	output := `{"message_type":"status","percent_done":1}
+{"message_type":"summary","snapshot_id":"1a2b3c"}
+`
+	assert.Equal(t, "1a2b3c", summarySnapshotID([]byte(output)))
+	assert.Equal(t, "", summarySnapshotID([]byte("not json")))
+}
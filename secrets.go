@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// secretVariables are the well-known environment variables holding secrets. They are masked
+// in log output even if they aren't named like credentials.
+var secretVariables = []string{
+	"RESTIC_PASSWORD",
+	"SECONDARY_PASSWORD",
+	"TRIGGER_TOKEN",
+	"TRIGGER_PASSWORD",
+	"METRICS_TOKEN",
+	"METRICS_PASSWORD",
+	"RESTIC_REST_PASSWORD",
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"B2_ACCOUNT_ID",
+	"B2_ACCOUNT_KEY",
+	"AZURE_ACCOUNT_KEY",
+	"AZURE_ACCOUNT_SAS",
+	"GOOGLE_ACCESS_TOKEN",
+	"OS_PASSWORD",
+	"OS_APPLICATION_CREDENTIAL_SECRET",
+	"ST_KEY",
+	"PGPASSWORD",
+	"MYSQL_PWD",
+}
+
+// pathVariables are the settings of restic-robot which end in _FILE but name files which are
+// used as they are
+var pathVariables = map[string]bool{
+	"CONFIG_FILE":        true,
+	"STATE_FILE":         true,
+	"TLS_CERT_FILE":      true,
+	"TLS_KEY_FILE":       true,
+	"TLS_CLIENT_CA_FILE": true,
+}
+
+// matchPathVariable matches variables of other programs which name certificates and configuration
+// files, e.g. SSL_CERT_FILE or AWS_SHARED_CREDENTIALS_FILE
+var matchPathVariable = regexp.MustCompile(`(^|_)(CONFIG|CERTS?|CA|CREDENTIALS|IDENTITY_TOKEN)_FILE$`)
+
+// secretFile returns the name of the variable which a NAME_FILE variable provides the value of
+func secretFile(key string) (string, bool) {
+	name, ok := strings.CutSuffix(key, "_FILE")
+	if !ok || name == "" || pathVariables[key] {
+		return "", false
+	}
+	if matchPathVariable.MatchString(key) && !contains(secretVariables, name) {
+		return "", false
+	}
+	return name, true
+}
+
+// loadSecrets resolves _FILE variables and RESTIC_PASSWORD_COMMAND into the environment,
+// from where the configuration is read and child restic processes inherit them.
+// All secrets are registered for redaction from log output.
+func loadSecrets() error {
+	for _, env := range os.Environ() {
+		key, file, _ := strings.Cut(env, "=")
+		name, ok := secretFile(key)
+		if !ok || file == "" {
+			continue
+		}
+		known := contains(secretVariables, name)
+		if os.Getenv(name) != "" {
+			if known {
+				return errors.Errorf("%s and %s are mutually exclusive", name, key)
+			}
+			// NAME_FILE may mean something else to the program reading NAME
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", key)
+		}
+		value := strings.TrimRight(string(content), "\r\n")
+		os.Setenv(name, value)
+		secrets.add(value)
+		if known {
+			// restic would otherwise read the password file once more
+			os.Unsetenv(key)
+		}
+	}
+
+	if command := os.Getenv("RESTIC_PASSWORD_COMMAND"); command != "" {
+		if os.Getenv("RESTIC_PASSWORD") != "" {
+			return errors.New("RESTIC_PASSWORD and RESTIC_PASSWORD_COMMAND are mutually exclusive")
+		}
+		args := parseArg(command)
+		if len(args) == 0 {
+			return errors.New("RESTIC_PASSWORD_COMMAND is empty")
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			// the command line itself may contain secrets, so it is not included
+			return errors.Wrap(err, "running RESTIC_PASSWORD_COMMAND")
+		}
+		os.Setenv("RESTIC_PASSWORD", strings.TrimRight(string(out), "\r\n"))
+		os.Unsetenv("RESTIC_PASSWORD_COMMAND")
+	}
+
+	registerSecrets()
+	return nil
+}
+
+// registerSecrets masks the values of the secret variables and of all variables named like
+// credentials in log output
+func registerSecrets() {
+	for _, name := range secretVariables {
+		secrets.add(os.Getenv(name))
+	}
+	secrets.addEnvironment()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// startServers starts the metrics and trigger servers, sharing a single listener
+// unless the trigger is configured with an address of its own
+func (b *backup) startServers() {
+	cfg := b.conf()
+	metricsEnabled := cfg.PrometheusAddress != ""
+	triggerAddress := cfg.TriggerAddress
+	if triggerAddress == "" {
+		triggerAddress = cfg.PrometheusAddress
+	}
+	if !metricsEnabled && triggerAddress == "" {
+		logger.Info("metrics and manual trigger disabled")
+		return
+	}
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		logger.Fatal("failed to configure TLS", zap.Error(err))
+	}
+
+	if metricsEnabled && triggerAddress == cfg.PrometheusAddress {
+		mux := http.NewServeMux()
+		b.setupMetrics(mux)
+		b.setupTrigger(mux)
+		b.setupAPI(mux)
+		go serve("metrics and trigger", cfg.PrometheusAddress, mux, tlsConfig)
+		return
+	}
+
+	if metricsEnabled {
+		mux := http.NewServeMux()
+		b.setupMetrics(mux)
+		go serve("metrics", cfg.PrometheusAddress, mux, tlsConfig)
+	} else {
+		logger.Info("metrics disabled")
+	}
+	mux := http.NewServeMux()
+	b.setupTrigger(mux)
+	b.setupAPI(mux)
+	go serve("trigger", triggerAddress, mux, tlsConfig)
+}
+
+// serve runs an HTTP server on the given address until it fails
+func serve(name, address string, handler http.Handler, tlsConfig *tls.Config) {
+	listener, err := listen(address)
+	if err != nil {
+		logger.Fatal("failed to listen", zap.String("server", name), zap.Error(err))
+	}
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		logger.Info(name + " server listening with TLS at " + address)
+		// certificates are provided by the TLS config
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		logger.Info(name + " server listening at " + address)
+		err = server.Serve(listener)
+	}
+	logger.Fatal(name+" server closed", zap.Error(err))
+}
+
+// listen opens a TCP listener, or a Unix socket for addresses of the form unix:/path
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	// remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "removing stale socket")
+	}
+	return net.Listen("unix", path)
+}
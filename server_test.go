@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_listen(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		l, err := listen("127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		assert.Equal(t, "tcp", l.Addr().Network())
+	})
+	t.Run("unix", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "trigger.sock")
+		l, err := listen("unix:" + path)
+		require.NoError(t, err)
+		defer l.Close()
+		assert.Equal(t, "unix", l.Addr().Network())
+
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		conn.Close()
+	})
+	t.Run("stale unix socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "trigger.sock")
+		stale, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		// keep the socket file around like a crashed process would
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		l, err := listen("unix:" + path)
+		require.NoError(t, err)
+		l.Close()
+	})
+}
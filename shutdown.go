@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// errShutdown fails runs which would start after the process was asked to exit
+var errShutdown = errors.New("shutting down")
+
+// shutdownSignals returns a channel receiving the signals asking the process to exit
+func shutdownSignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return signals
+}
+
+// shutdownOn waits for a signal, then interrupts the running backup and returns once it has
+// cleaned up: suspended containers are running again and the filesystem snapshot is removed.
+// A second signal terminates the process right away.
+func (b *backup) shutdownOn(signals chan os.Signal, sched *scheduler) {
+	sig := <-signals
+	signal.Stop(signals)
+	logger.Info("shutting down, waiting for the running backup to clean up", zap.Stringer("signal", sig))
+	b.shutdown(sched)
+	logger.Info("shutdown complete")
+}
+
+// shutdown stops scheduling backups, interrupts the running one and waits until it finished.
+// Runs which would start afterwards block until the process exits.
+func (b *backup) shutdown(sched *scheduler) {
+	if sched != nil {
+		sched.stop()
+	}
+	b.cancel()
+	b.running.Lock()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_shutdownDuringRun(t *testing.T) {
+	docker := newFakeDocker()
+	fake := &fakeRunner{script: map[string]fakeResult{"backup": {block: true}}}
+	b := newTestBackup()
+	b.restic = fake
+	cfg := b.conf()
+	cfg.StopContainers = true
+	cfg.DockerHost = startFakeDocker(t, docker)
+
+	r := newRun(triggerManual, runOptions{})
+	go b.execute(r)
+	// wait for restic to run with the containers suspended
+	for deadline := time.Now().Add(5 * time.Second); len(fake.invocations()) == 0; time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Now().Before(deadline), "backup did not start")
+	}
+
+	signals := shutdownSignals()
+	done := make(chan struct{})
+	go func() {
+		b.shutdownOn(signals, nil)
+		close(done)
+	}()
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+
+	// the containers are back up before the process exits
+	docker.mu.Lock()
+	assert.Equal(t, []string{"stop db", "pause cache", "unpause cache", "start db"}, docker.calls)
+	docker.mu.Unlock()
+	result := r.Result()
+	assert.Equal(t, runStatusFailed, result.Status)
+	assert.Contains(t, result.Error, "interrupted by shutdown")
+}
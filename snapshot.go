@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// snapshotNone backs up the live filesystem
+	snapshotNone = ""
+	// snapshotBtrfs snapshots a Btrfs subvolume
+	snapshotBtrfs = "btrfs"
+	// snapshotZFS snapshots a ZFS dataset
+	snapshotZFS = "zfs"
+	// snapshotLVM snapshots an LVM logical volume
+	snapshotLVM = "lvm"
+
+	// snapshotName is the name of the snapshots created for backups
+	snapshotName = "restic-robot"
+	// lvmMountPoint is where LVM snapshots are mounted
+	lvmMountPoint = "/run/restic-robot/snapshot"
+
+	// bindScript bind-mounts $1 onto $2 and runs the remaining arguments, it is run in a
+	// private mount namespace so that the mount is only visible to restic
+	bindScript = `mount --bind "$1" "$2" && shift 2 && exec "$@"`
+)
+
+// snapshotTools are the executables required by each provider
+var snapshotTools = map[string][]string{
+	snapshotBtrfs: {"btrfs", "unshare", "mount"},
+	snapshotZFS:   {"zfs", "unshare", "mount"},
+	snapshotLVM:   {"lvcreate", "lvremove", "mount", "umount", "unshare"},
+}
+
+// snapshotProvider creates and removes a filesystem snapshot of SNAPSHOT_SOURCE
+type snapshotProvider interface {
+	// create takes the snapshot and returns the path its contents are accessible at
+	create() (string, error)
+	// remove tears the snapshot down
+	remove() error
+}
+
+// snapshotProvider returns the configured provider, or nil if snapshots are disabled
+func (c *config) snapshotProvider() snapshotProvider {
+	switch c.SnapshotProvider {
+	case snapshotBtrfs:
+		return btrfsSnapshot{source: c.SnapshotSource}
+	case snapshotZFS:
+		return zfsSnapshot{source: c.SnapshotSource, dataset: c.SnapshotVolume}
+	case snapshotLVM:
+		return lvmSnapshot{volume: c.SnapshotVolume, size: c.SnapshotSize, mountPoint: lvmMountPoint}
+	}
+	return nil
+}
+
+// btrfsSnapshot creates a read-only snapshot of a subvolume inside of it. Snapshots have to be
+// on the same filesystem, which the parent directory of a mounted subvolume usually isn't.
+type btrfsSnapshot struct {
+	source string
+}
+
+func (s btrfsSnapshot) path() string {
+	return filepath.Join(s.source, "."+snapshotName+"-snapshot")
+}
+
+func (s btrfsSnapshot) create() (string, error) {
+	return s.path(), runCommand("btrfs", "subvolume", "snapshot", "-r", s.source, s.path())
+}
+
+func (s btrfsSnapshot) remove() error {
+	return runCommand("btrfs", "subvolume", "delete", s.path())
+}
+
+// zfsSnapshot snapshots a dataset, which is accessible below the .zfs directory of its mount point
+type zfsSnapshot struct {
+	source  string
+	dataset string
+}
+
+func (s zfsSnapshot) create() (string, error) {
+	path := filepath.Join(s.source, ".zfs", "snapshot", snapshotName)
+	return path, runCommand("zfs", "snapshot", s.dataset+"@"+snapshotName)
+}
+
+func (s zfsSnapshot) remove() error {
+	return runCommand("zfs", "destroy", s.dataset+"@"+snapshotName)
+}
+
+// lvmSnapshot creates a copy-on-write snapshot volume of a logical volume and mounts it
+type lvmSnapshot struct {
+	// volume is the logical volume as vg/lv
+	volume string
+	// size is the space reserved for changes to the origin while the snapshot exists
+	size string
+	// mountPoint is where the snapshot is mounted
+	mountPoint string
+}
+
+func (s lvmSnapshot) snapshotVolume() string {
+	return filepath.Join(filepath.Dir(s.volume), filepath.Base(s.volume)+"-"+snapshotName)
+}
+
+func (s lvmSnapshot) create() (string, error) {
+	err := runCommand("lvcreate", "--snapshot", "--name", filepath.Base(s.snapshotVolume()), "--size", s.size, s.volume)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.mountPoint, 0o700); err != nil {
+		return "", errors.Wrap(err, "creating mount point")
+	}
+	// nouuid allows mounting XFS snapshots next to their origin
+	options := "ro"
+	if out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", "/dev/"+s.snapshotVolume()).Output(); err == nil &&
+		strings.TrimSpace(string(out)) == "xfs" {
+		options += ",nouuid"
+	}
+	return s.mountPoint, runCommand("mount", "-o", options, "/dev/"+s.snapshotVolume(), s.mountPoint)
+}
+
+func (s lvmSnapshot) remove() error {
+	// the snapshot may not have been mounted if creating it failed halfway
+	umountErr := runCommand("umount", s.mountPoint)
+	if err := runCommand("lvremove", "--yes", s.snapshotVolume()); err != nil {
+		if umountErr != nil {
+			return errors.Wrap(umountErr, err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// runCommand runs a command and includes its output in the error
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("%s %s: %v, %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// takeSnapshot creates the configured snapshot, removing one left behind by an interrupted
+// run first. The returned function removes the snapshot and is safe to call repeatedly.
+func (c *config) takeSnapshot() (string, func(), error) {
+	provider := c.snapshotProvider()
+	if provider == nil {
+		return "", func() {}, nil
+	}
+	if err := provider.remove(); err == nil {
+		logger.Warn("removed stale snapshot", zap.String("provider", c.SnapshotProvider))
+	}
+	removed := false
+	remove := func() {
+		if removed {
+			return
+		}
+		removed = true
+		if err := provider.remove(); err != nil {
+			logger.Error("failed to remove snapshot", zap.String("provider", c.SnapshotProvider), zap.Error(err))
+		} else {
+			logger.Info("snapshot removed", zap.String("provider", c.SnapshotProvider))
+		}
+	}
+	path, err := provider.create()
+	if err != nil {
+		remove()
+		return "", remove, errors.Wrap(err, "creating snapshot")
+	}
+	logger.Info("snapshot created", zap.String("provider", c.SnapshotProvider), zap.String("path", path))
+	return path, remove, nil
+}
+
+// bindSnapshot makes the command run in a private mount namespace with the snapshot mounted
+// over the source, so that restic records the original paths
+func bindSnapshot(cmd *exec.Cmd, snapshot, source string) {
+	path, err := exec.LookPath("unshare")
+	cmd.Args = append([]string{"unshare", "--mount", "--propagation", "private",
+		"sh", "-c", bindScript, "restic-robot", snapshot, source}, cmd.Args...)
+	cmd.Path = path
+	if err != nil {
+		// keeps an error recorded for restic itself
+		cmd.Err = err
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubScript logs its invocation and fails if it starts with $STUB_FAIL
+const stubScript = `#!/bin/sh
+echo "$(basename "$0") $*" >> "$STUB_LOG"
+if [ -n "$STUB_FAIL" ]; then
+	case "$(basename "$0") $*" in "$STUB_FAIL"*) echo failed >&2; exit 1;; esac
+fi
+if [ "$(basename "$0")" = blkid ]; then echo xfs; fi
+`
+
+// stubCommands puts stubs of the given commands first in PATH and returns a function
+// reading the logged invocations
+func stubCommands(t *testing.T, names ...string) func() []string {
+	dir := t.TempDir()
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(stubScript), 0o755))
+	}
+	log := filepath.Join(dir, "calls.log")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("STUB_LOG", log)
+	t.Setenv("STUB_FAIL", "")
+	return func() []string {
+		content, _ := os.ReadFile(log)
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+}
+
+func Test_takeSnapshot(t *testing.T) {
+	tests := []struct {
+		provider snapshotProvider
+		wantPath string
+		want     []string
+	}{
+		{
+			btrfsSnapshot{source: "/data"},
+			"/data/.restic-robot-snapshot",
+			[]string{
+				"btrfs subvolume delete /data/.restic-robot-snapshot",
+				"btrfs subvolume snapshot -r /data /data/.restic-robot-snapshot",
+				"btrfs subvolume delete /data/.restic-robot-snapshot",
+			},
+		},
+		{
+			zfsSnapshot{source: "/data", dataset: "tank/data"},
+			"/data/.zfs/snapshot/restic-robot",
+			[]string{
+				"zfs destroy tank/data@restic-robot",
+				"zfs snapshot tank/data@restic-robot",
+				"zfs destroy tank/data@restic-robot",
+			},
+		},
+		{
+			lvmSnapshot{volume: "vg0/data", size: "2G", mountPoint: "MOUNT"},
+			"MOUNT",
+			[]string{
+				"umount MOUNT",
+				"lvremove --yes vg0/data-restic-robot",
+				"lvcreate --snapshot --name data-restic-robot --size 2G vg0/data",
+				"blkid -o value -s TYPE /dev/vg0/data-restic-robot",
+				"mount -o ro,nouuid /dev/vg0/data-restic-robot MOUNT",
+				"umount MOUNT",
+				"lvremove --yes vg0/data-restic-robot",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Fields(tt.want[1])[0], func(t *testing.T) {
+			calls := stubCommands(t, "btrfs", "zfs", "lvcreate", "lvremove", "mount", "umount", "blkid")
+			if lvm, ok := tt.provider.(lvmSnapshot); ok {
+				lvm.mountPoint = filepath.Join(t.TempDir(), "snapshot")
+				tt.provider = lvm
+				tt.wantPath = lvm.mountPoint
+				for i := range tt.want {
+					tt.want[i] = strings.ReplaceAll(tt.want[i], "MOUNT", lvm.mountPoint)
+				}
+			}
+			// like takeSnapshot, a stale snapshot is removed first
+			require.NoError(t, tt.provider.remove())
+			path, err := tt.provider.create()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPath, path)
+			require.NoError(t, tt.provider.remove())
+			assert.Equal(t, tt.want, calls())
+		})
+	}
+}
+
+func Test_takeSnapshotFailure(t *testing.T) {
+	calls := stubCommands(t, "btrfs")
+	t.Setenv("STUB_FAIL", "btrfs subvolume snapshot")
+	cfg := &config{SnapshotProvider: snapshotBtrfs, SnapshotSource: "/srv/data"}
+
+	_, remove, err := cfg.takeSnapshot()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed")
+	// a partially created snapshot is removed right away, and only once
+	remove()
+	assert.Equal(t, []string{
+		"btrfs subvolume delete /srv/data/.restic-robot-snapshot",
+		"btrfs subvolume snapshot -r /srv/data /srv/data/.restic-robot-snapshot",
+		"btrfs subvolume delete /srv/data/.restic-robot-snapshot",
+	}, calls())
+}
+
+func Test_bindSnapshot(t *testing.T) {
+	cmd := exec.Command("restic", "backup", "--json", "/data")
+	bindSnapshot(cmd, "/data/.restic-robot-snapshot", "/data")
+	assert.Equal(t, []string{
+		"unshare", "--mount", "--propagation", "private",
+		"sh", "-c", bindScript, "restic-robot", "/data/.restic-robot-snapshot", "/data",
+		"restic", "backup", "--json", "/data",
+	}, cmd.Args)
+
+	// the wrapper passes the remaining arguments through unchanged
+	stubCommands(t, "mount", "unshare")
+	out, err := exec.Command("sh", "-c", bindScript, "restic-robot", "/a", "/b", "echo", "a b", "c").Output()
+	require.NoError(t, err)
+	assert.Equal(t, "a b c\n", string(out))
+
+	// a missing restic is still reported when unshare exists
+	cmd = exec.Command("restic-robot-missing-restic", "backup")
+	bindSnapshot(cmd, "/data/.restic-robot-snapshot", "/data")
+	assert.Error(t, cmd.Err)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sourceFiles backs up the paths given in RESTIC_ARGS
+	sourceFiles = ""
+	// sourcePostgres streams the output of pg_dump
+	sourcePostgres = "postgres"
+	// sourceMySQL streams the output of mysqldump
+	sourceMySQL = "mysql"
+	// sourceSQLite streams a dump of an SQLite database file
+	sourceSQLite = "sqlite"
+	// sourceCustom streams the output of SOURCE_COMMAND
+	sourceCustom = "command"
+
+	// resticStopTimeout is how long restic may take to remove its locks after being interrupted
+	resticStopTimeout = 30 * time.Second
+
+	// maxSourceErrorOutput limits the amount of stderr of a failed producer kept in the run result
+	maxSourceErrorOutput = 4096
+)
+
+// sourceTools are the executables producing the dumps of each source type
+var sourceTools = map[string]string{
+	sourcePostgres: "pg_dump",
+	sourceMySQL:    "mysqldump",
+	sourceSQLite:   "sqlite3",
+}
+
+// sourceResult is the outcome of the command producing the data of a stdin source
+type sourceResult struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// validSourceType returns true if the source type is known
+func validSourceType(t string) bool {
+	_, ok := sourceTools[t]
+	return t == sourceFiles || t == sourceCustom || ok
+}
+
+// sourceFilename returns the name the streamed data is stored under in the snapshot
+func (c *config) sourceFilename() string {
+	if c.SourceFilename != "" {
+		return c.SourceFilename
+	}
+	if c.SourceType == sourceCustom {
+		// the default of restic
+		return "stdin"
+	}
+	return strings.TrimSuffix(filepath.Base(c.SourceDatabase), filepath.Ext(c.SourceDatabase)) + ".sql"
+}
+
+// sourceContext derives the context limiting the duration of a backup from a source
+func (c *config) sourceContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if c.SourceType == sourceFiles || c.SourceTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, c.SourceTimeout)
+}
+
+// sourceCommand returns the command producing the data to back up, or nil when backing up files.
+// The producer is killed once the context is done.
+func (c *config) sourceCommand(ctx context.Context) *exec.Cmd {
+	args := parseArg(c.SourceArgs)
+	switch c.SourceType {
+	case sourceCustom:
+		parts := parseArg(c.SourceCommand)
+		if len(parts) == 0 {
+			return nil
+		}
+		cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+		cmd.WaitDelay = resticStopTimeout
+		return cmd
+
+	case sourcePostgres:
+		args = append(args, c.SourceDatabase)
+	case sourceMySQL:
+		args = append(append([]string{"--single-transaction"}, args...), c.SourceDatabase)
+	case sourceSQLite:
+		// `.backup` writes a database file and needs a seekable destination, so a
+		// consistent text dump is streamed instead
+		args = append(append(args, c.SourceDatabase), ".dump")
+	default:
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, sourceTools[c.SourceType], args...)
+	cmd.WaitDelay = resticStopTimeout
+	return cmd
+}
+
+// resticCommand returns a restic command which is interrupted once the context is done,
+// giving restic the chance to remove its locks before it is killed
+func resticCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, resticBinary, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = resticStopTimeout
+	return cmd
+}
+
+// runWithSource runs restic, feeding it the output of the producer if there is one.
+// Both processes have to succeed, a failing producer leaves a truncated dump behind.
+func runWithSource(cmd *exec.Cmd, producer *exec.Cmd) (*sourceResult, error) {
+	if producer == nil {
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return nil, cmd.Wait()
+	}
+
+	result := &sourceResult{Command: filepath.Base(producer.Path)}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating pipe")
+	}
+	errbuf := &bytes.Buffer{}
+	producer.Stdout = writer
+	producer.Stderr = errbuf
+	cmd.Stdin = reader
+	err = producer.Start()
+	writer.Close()
+	if err != nil {
+		reader.Close()
+		result.ExitCode = -1
+		result.Error = err.Error()
+		return result, errors.Wrapf(err, "starting %s", result.Command)
+	}
+
+	resticErr := cmd.Start()
+	// restic holds the read end now, closing ours lets the producer fail if restic does
+	reader.Close()
+	producerErr := producer.Wait()
+	if resticErr == nil {
+		resticErr = cmd.Wait()
+	}
+
+	result.ExitCode = producer.ProcessState.ExitCode()
+	if producerErr != nil {
+		output := strings.TrimSpace(errbuf.String())
+		if len(output) > maxSourceErrorOutput {
+			output = output[len(output)-maxSourceErrorOutput:]
+		}
+		result.Error = secrets.redact(strings.TrimSpace(producerErr.Error() + ": " + output))
+	}
+	if resticErr != nil {
+		return result, resticErr
+	}
+	if producerErr != nil {
+		return result, errors.Errorf("%s: %s", result.Command, result.Error)
+	}
+	return result, nil
+}
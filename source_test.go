@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sourceCommand(t *testing.T) {
+	tests := []struct {
+		cfg          config
+		wantArgs     []string
+		wantFilename string
+	}{
+		{config{}, nil, ""},
+		{config{SourceType: sourcePostgres, SourceDatabase: "app", SourceArgs: "--clean"},
+			[]string{"pg_dump", "--clean", "app"}, "app.sql"},
+		{config{SourceType: sourceMySQL, SourceDatabase: "app", SourceFilename: "mysql/app.sql"},
+			[]string{"mysqldump", "--single-transaction", "app"}, "mysql/app.sql"},
+		{config{SourceType: sourceSQLite, SourceDatabase: "/data/app.db"},
+			[]string{"sqlite3", "/data/app.db", ".dump"}, "app.sql"},
+		{config{SourceType: sourceCustom, SourceCommand: `etcdctl snapshot save -`},
+			[]string{"etcdctl", "snapshot", "save", "-"}, "stdin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg.SourceType, func(t *testing.T) {
+			cmd := tt.cfg.sourceCommand(context.Background())
+			if tt.wantArgs == nil {
+				assert.Nil(t, cmd)
+				return
+			}
+			require.NotNil(t, cmd)
+			assert.Equal(t, tt.wantArgs, cmd.Args)
+			assert.Equal(t, []string{"backup", "--json", "--stdin", "--stdin-filename", tt.wantFilename},
+				tt.cfg.backupArgs(runOptions{}))
+		})
+	}
+}
+
+func Test_runWithSource(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		cmd := exec.Command("cat")
+		cmd.Stdout = out
+		result, err := runWithSource(cmd, exec.Command("printf", "dump"))
+		require.NoError(t, err)
+		assert.Equal(t, "dump", out.String())
+		assert.Equal(t, &sourceResult{Command: "printf"}, result)
+	})
+
+	t.Run("producer fails", func(t *testing.T) {
+		cmd := exec.Command("cat")
+		producer := exec.Command("sh", "-c", "echo partial; echo connection refused >&2; exit 3")
+		result, err := runWithSource(cmd, producer)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+		assert.Equal(t, 3, result.ExitCode)
+		assert.Contains(t, result.Error, "connection refused")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		cfg := &config{SourceType: sourceCustom, SourceCommand: "sleep 10", SourceTimeout: 100 * time.Millisecond}
+		ctx, cancel := cfg.sourceContext(context.Background())
+		defer cancel()
+		started := time.Now()
+		result, err := runWithSource(exec.CommandContext(ctx, "cat"), cfg.sourceCommand(ctx))
+		require.Error(t, err)
+		assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+		assert.Equal(t, -1, result.ExitCode)
+		assert.True(t, time.Since(started) < 5*time.Second)
+	})
+
+	t.Run("restic fails", func(t *testing.T) {
+		// the producer must not block forever once nobody reads its output
+		cmd := exec.Command("sh", "-c", "exit 1")
+		result, err := runWithSource(cmd, exec.Command("yes"))
+		require.Error(t, err)
+		assert.NotEqual(t, 0, result.ExitCode)
+	})
+}
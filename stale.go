@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// staleCheckInterval is how often the age of the last successful backup is checked
+const staleCheckInterval = time.Minute
+
+// watchdog notifies when no backup succeeded within STALE_THRESHOLD, and again once a backup
+// succeeds. Unlike ERROR_COMMAND it also fires when backups don't run at all.
+type watchdog struct {
+	b     *backup
+	stale bool
+}
+
+// watchStaleness checks the age of the last successful backup until the process exits
+func (b *backup) watchStaleness() {
+	w := &watchdog{b: b}
+	for now := range time.Tick(staleCheckInterval) {
+		w.check(now)
+	}
+}
+
+// check notifies if the staleness of the backups changed
+func (w *watchdog) check(now time.Time) {
+	cfg := w.b.conf()
+	if cfg.StaleThreshold <= 0 {
+		// the watchdog was disabled by a reload
+		w.stale = false
+		w.b.backupsStale.Set(0)
+		return
+	}
+	last, ok := w.b.lastBackup()
+	stale := now.Sub(last) > cfg.StaleThreshold
+	if stale == w.stale {
+		return
+	}
+	w.stale = stale
+	if stale {
+		w.b.backupsStale.Set(1)
+		fields := []zap.Field{zap.Duration("threshold", cfg.StaleThreshold)}
+		if ok {
+			fields = append(fields, zap.Time("last", last))
+		}
+		logger.Error("no backup succeeded within the stale threshold", fields...)
+		runHook("stale-command", cfg.staleCommand())
+	} else {
+		w.b.backupsStale.Set(0)
+		logger.Info("backups recovered", zap.Time("last", last))
+		runHook("recovered-command", cfg.RecoveredCommand)
+	}
+}
+
+// staleCommand returns the command notifying about stale backups
+func (c *config) staleCommand() string {
+	if c.StaleCommand != "" {
+		return c.StaleCommand
+	}
+	return c.ErrorCommand
+}
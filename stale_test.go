@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_watchdog(t *testing.T) {
+	calls := stubCommands(t, "notify")
+	b := newTestBackup()
+	start := time.Now()
+	b.health.started = start
+	b.conf().StaleThreshold = time.Hour
+	b.conf().ErrorCommand = "notify error"
+	b.conf().RecoveredCommand = "notify recovered"
+	w := &watchdog{b: b}
+
+	w.check(start.Add(30 * time.Minute))
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.backupsStale))
+
+	// without any backup, the age counts from startup and STALE_COMMAND defaults to ERROR_COMMAND
+	w.check(start.Add(61 * time.Minute))
+	w.check(start.Add(62 * time.Minute))
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.backupsStale))
+	assert.Equal(t, []string{"notify error"}, calls())
+
+	b.health.lastSuccess.Store(start.Add(63 * time.Minute).Unix())
+	w.check(start.Add(64 * time.Minute))
+	w.check(start.Add(65 * time.Minute))
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.backupsStale))
+	assert.Equal(t, []string{"notify error", "notify recovered"}, calls())
+
+	b.conf().StaleCommand = "notify stale"
+	w.check(start.Add(3 * time.Hour))
+	assert.Equal(t, []string{"notify error", "notify recovered", "notify stale"}, calls())
+
+	// disabling the watchdog resets it without notifying
+	b.conf().StaleThreshold = 0
+	w.check(start.Add(4 * time.Hour))
+	assert.False(t, w.stale)
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.backupsStale))
+	assert.Len(t, calls(), 3)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IO scheduling classes understood by ioprio_set(2)
+const (
+	ioClassNone       = 0
+	ioClassRealtime   = 1
+	ioClassBestEffort = 2
+	ioClassIdle       = 3
+)
+
+// ioClasses maps the names accepted in IONICE to IO scheduling classes
+var ioClasses = map[string]int{
+	"none":        ioClassNone,
+	"realtime":    ioClassRealtime,
+	"best-effort": ioClassBestEffort,
+	"idle":        ioClassIdle,
+}
+
+// ioPriority is an IO scheduling class and level like "best-effort:7" or "idle"
+type ioPriority struct {
+	class int
+	level int
+}
+
+// Decode implements envconfig.Decoder
+func (p *ioPriority) Decode(value string) error {
+	name, level, hasLevel := strings.Cut(strings.TrimSpace(value), ":")
+	class, ok := ioClasses[name]
+	if !ok {
+		return errors.Errorf("unknown IO class %q, must be one of idle, best-effort or realtime", name)
+	}
+	*p = ioPriority{class: class}
+	if !hasLevel {
+		if class == ioClassBestEffort || class == ioClassRealtime {
+			// the default level of the kernel
+			p.level = 4
+		}
+		return nil
+	}
+	if class != ioClassBestEffort && class != ioClassRealtime {
+		return errors.Errorf("IO class %q does not take a level", name)
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < 0 || n > 7 {
+		return errors.Errorf("invalid IO level %q, must be between 0 and 7", level)
+	}
+	p.level = n
+	return nil
+}
+
+// String renders the priority in the format read by Decode
+func (p ioPriority) String() string {
+	for name, class := range ioClasses {
+		if class != p.class {
+			continue
+		}
+		if class == ioClassBestEffort || class == ioClassRealtime {
+			return name + ":" + strconv.Itoa(p.level)
+		}
+		return name
+	}
+	return strconv.Itoa(p.class)
+}
+
+// throttle limits the resources used by the restic process
+type throttle struct {
+	// limitUpload and limitDownload are in KiB/s, 0 is unlimited
+	limitUpload   int
+	limitDownload int
+	// nice is the niceness of the process
+	nice   int
+	ionice ioPriority
+}
+
+// args returns the global restic flags applying the bandwidth limits
+func (t throttle) args() []string {
+	var args []string
+	if t.limitUpload > 0 {
+		args = append(args, "--limit-upload", strconv.Itoa(t.limitUpload))
+	}
+	if t.limitDownload > 0 {
+		args = append(args, "--limit-download", strconv.Itoa(t.limitDownload))
+	}
+	return args
+}
+
+// prioritized returns true if the process priority has to be changed
+func (t throttle) prioritized() bool {
+	return t.nice != 0 || t.ionice.class != ioClassNone
+}
+
+// wrapper returns the nice and ionice command line the restic process is started through
+func (t throttle) wrapper() []string {
+	var args []string
+	if t.nice != 0 {
+		args = append(args, "nice", "-n", strconv.Itoa(t.nice))
+	}
+	switch t.ionice.class {
+	case ioClassNone:
+	case ioClassBestEffort, ioClassRealtime:
+		args = append(args, "ionice", "-c", strconv.Itoa(t.ionice.class), "-n", strconv.Itoa(t.ionice.level))
+	default:
+		args = append(args, "ionice", "-c", strconv.Itoa(t.ionice.class))
+	}
+	return args
+}
+
+// prioritize starts the command through nice and ionice, so the priority is in place
+// before restic runs and is inherited by all of its threads
+func prioritize(cmd *exec.Cmd, th throttle) {
+	wrapper := th.wrapper()
+	if len(wrapper) == 0 {
+		return
+	}
+	path, err := exec.LookPath(wrapper[0])
+	cmd.Args = append(append(wrapper, cmd.Path), cmd.Args[1:]...)
+	cmd.Path = path
+	if cmd.Err == nil {
+		cmd.Err = err
+	}
+}
+
+// priorityCommands returns the executables needed to apply the configured priorities
+func (c *config) priorityCommands() []string {
+	nice, ionice := c.Nice != 0, c.IONice.class != ioClassNone
+	for _, p := range c.ThrottleProfiles {
+		nice = nice || (p.nice != nil && *p.nice != 0)
+		ionice = ionice || (p.ionice != nil && p.ionice.class != ioClassNone)
+	}
+	var names []string
+	if nice {
+		names = append(names, "nice")
+	}
+	if ionice {
+		names = append(names, "ionice")
+	}
+	return names
+}
+
+// throttleProfile overrides some throttle settings during a window
+type throttleProfile struct {
+	spec   string
+	window timeWindow
+
+	limitUpload   *int
+	limitDownload *int
+	nice          *int
+	ionice        *ioPriority
+}
+
+// parseThrottleProfile parses a profile of the form "<window> key=value...", e.g.
+// "Mon-Fri 08:00-20:00 upload=1024 nice=10 ionice=idle"
+func parseThrottleProfile(spec string) (throttleProfile, error) {
+	p := throttleProfile{spec: strings.TrimSpace(spec)}
+	var window []string
+	for _, field := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			window = append(window, field)
+			continue
+		}
+		var err error
+		switch key {
+		case "upload":
+			p.limitUpload, err = parseLimit(value)
+		case "download":
+			p.limitDownload, err = parseLimit(value)
+		case "nice":
+			p.nice, err = parseNice(value)
+		case "ionice":
+			p.ionice = &ioPriority{}
+			err = p.ionice.Decode(value)
+		default:
+			err = errors.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return p, errors.Wrapf(err, "invalid throttle profile %q", spec)
+		}
+	}
+	var err error
+	if p.window, err = parseWindow(strings.Join(window, " ")); err != nil {
+		return p, errors.Wrapf(err, "invalid throttle profile %q", spec)
+	}
+	return p, nil
+}
+
+// parseLimit parses a bandwidth limit in KiB/s
+func parseLimit(value string) (*int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("invalid limit %q", value)
+	}
+	return &n, nil
+}
+
+// parseNice parses a niceness
+func parseNice(value string) (*int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < -20 || n > 19 {
+		return nil, errors.Errorf("invalid niceness %q, must be between -20 and 19", value)
+	}
+	return &n, nil
+}
+
+// apply overrides the settings configured in the profile
+func (p throttleProfile) apply(t *throttle) {
+	if p.limitUpload != nil {
+		t.limitUpload = *p.limitUpload
+	}
+	if p.limitDownload != nil {
+		t.limitDownload = *p.limitDownload
+	}
+	if p.nice != nil {
+		t.nice = *p.nice
+	}
+	if p.ionice != nil {
+		t.ionice = *p.ionice
+	}
+}
+
+// throttleProfiles is a semicolon-separated list of profiles read from the environment
+type throttleProfiles []throttleProfile
+
+// Decode implements envconfig.Decoder
+func (l *throttleProfiles) Decode(value string) error {
+	*l = nil
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		p, err := parseThrottleProfile(spec)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, p)
+	}
+	return nil
+}
+
+// String returns the profiles as configured
+func (l throttleProfiles) String() string {
+	specs := make([]string, len(l))
+	for i, p := range l {
+		specs[i] = p.spec
+	}
+	return strings.Join(specs, "; ")
+}
+
+// throttleAt returns the throttle settings for a backup started at the given time,
+// the first profile whose window contains the time overrides the defaults
+func (c *config) throttleAt(t time.Time) throttle {
+	th := throttle{
+		limitUpload:   c.LimitUpload,
+		limitDownload: c.LimitDownload,
+		nice:          c.Nice,
+		ionice:        c.IONice,
+	}
+	t = t.In(c.location())
+	for _, p := range c.ThrottleProfiles {
+		if p.window.contains(t) {
+			p.apply(&th)
+			break
+		}
+	}
+	return th
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ioPriority_Decode(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ioPriority
+		wantErr bool
+	}{
+		{"idle", ioPriority{class: ioClassIdle}, false},
+		{"best-effort", ioPriority{class: ioClassBestEffort, level: 4}, false},
+		{"best-effort:7", ioPriority{class: ioClassBestEffort, level: 7}, false},
+		{"realtime:0", ioPriority{class: ioClassRealtime}, false},
+		{"idle:3", ioPriority{}, true},
+		{"best-effort:8", ioPriority{}, true},
+		{"lazy", ioPriority{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var p ioPriority
+			err := p.Decode(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, p)
+		})
+	}
+}
+
+func Test_parseThrottleProfile(t *testing.T) {
+	p, err := parseThrottleProfile("Mon-Fri 08:00-20:00 upload=1024 download=0 nice=10 ionice=idle")
+	require.NoError(t, err)
+	th := throttle{limitUpload: 1, limitDownload: 2, nice: 3}
+	p.apply(&th)
+	assert.Equal(t, throttle{limitUpload: 1024, nice: 10, ionice: ioPriority{class: ioClassIdle}}, th)
+
+	for _, spec := range []string{
+		"Mon-Fri 08:00-20:00 upload=fast",
+		"Mon-Fri 08:00-20:00 nice=20",
+		"Mon-Fri 08:00-20:00 bandwidth=10",
+		"upload=1024",
+	} {
+		_, err := parseThrottleProfile(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func Test_throttleAt(t *testing.T) {
+	cfg := &config{CronTZ: "UTC", LimitUpload: 4096, Nice: 5}
+	require.NoError(t, cfg.ThrottleProfiles.Decode("Mon-Fri 08:00-20:00 upload=512 ionice=idle; 20:00-08:00 upload=0"))
+
+	day := cfg.throttleAt(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, throttle{limitUpload: 512, nice: 5, ionice: ioPriority{class: ioClassIdle}}, day)
+	assert.Equal(t, []string{"--limit-upload", "512"}, day.args())
+	assert.True(t, day.prioritized())
+
+	night := cfg.throttleAt(time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC))
+	assert.Equal(t, throttle{nice: 5}, night)
+	assert.Empty(t, night.args())
+
+	weekend := cfg.throttleAt(time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, throttle{limitUpload: 4096, nice: 5}, weekend)
+}
+
+func Test_prioritize(t *testing.T) {
+	assert.Empty(t, throttle{limitUpload: 512}.wrapper())
+	assert.Equal(t, []string{"nice", "-n", "7", "ionice", "-c", "2", "-n", "6"},
+		throttle{nice: 7, ionice: ioPriority{class: ioClassBestEffort, level: 6}}.wrapper())
+
+	// `nice` without arguments prints the niceness it runs with
+	niceness := func(cmd *exec.Cmd) int {
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		n, err := strconv.Atoi(strings.TrimSpace(string(out)))
+		require.NoError(t, err)
+		return n
+	}
+	cmd := exec.Command("nice")
+	if cmd.Err != nil {
+		t.Skip("nice is not installed")
+	}
+	base := niceness(cmd)
+	cmd = exec.Command("nice")
+	prioritize(cmd, throttle{nice: 7, ionice: ioPriority{class: ioClassIdle}})
+	assert.Equal(t, []string{"nice", "-n", "7", "ionice", "-c", "3"}, cmd.Args[:6])
+	if cmd.Err != nil {
+		t.Skip("ionice is not installed")
+	}
+	assert.Equal(t, min(base+7, 19), niceness(cmd))
+}
+
+func Test_priorityCommands(t *testing.T) {
+	cfg := &config{}
+	assert.Empty(t, cfg.priorityCommands())
+	require.NoError(t, cfg.ThrottleProfiles.Decode("22:00-06:00 ionice=idle"))
+	assert.Equal(t, []string{"ionice"}, cfg.priorityCommands())
+	cfg.Nice = 10
+	assert.Equal(t, []string{"nice", "ionice"}, cfg.priorityCommands())
+}
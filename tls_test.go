@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate with its key, signed by parent or self-signed if parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files, dated at modTime
+func (c *testCert) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+// tlsCert returns the certificate for use by a TLS client
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func Test_certReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now()
+	first := newTestCert(t, "first", nil)
+	first.write(t, certFile, keyFile, now.Add(-time.Minute))
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	served, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.der, served.Certificate[0])
+
+	// rotated files are served on the next handshake
+	second := newTestCert(t, "second", nil)
+	second.write(t, certFile, keyFile, now)
+	served, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.der, served.Certificate[0])
+
+	// a broken certificate keeps the previous one in place
+	require.NoError(t, os.WriteFile(certFile, []byte("half-written"), 0o600))
+	require.NoError(t, os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute)))
+	served, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.der, served.Certificate[0])
+}
+
+func Test_mutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	newTestCert(t, "localhost", nil).write(t, certFile, keyFile, time.Now())
+	ca := newTestCert(t, "client-ca", nil)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0o600))
+
+	b := newTestBackup()
+	cfg := b.conf()
+	cfg.PrometheusEndpoint = "/metrics"
+	cfg.HealthEndpoint = "/healthz"
+	cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile = certFile, keyFile, caFile
+	b.health.nextRun.Store(time.Now().Add(time.Hour).Unix())
+	tlsConfig, err := cfg.tlsConfig()
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	b.setupMetrics(mux)
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(path string, certs ...tls.Certificate) (int, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			// present the certificate even when the server asks for another CA
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &certs[0], nil
+			},
+		}}}
+		res, err := client.Get(server.URL + path)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	status, err := get("/metrics")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, err = get("/metrics", newTestCert(t, "client", ca).tlsCert())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// health probes don't need a certificate
+	status, err = get("/healthz")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// certificates which are given have to be signed by the CA
+	_, err = get("/healthz", newTestCert(t, "stranger", newTestCert(t, "other-ca", nil)).tlsCert())
+	assert.Error(t, err)
+}
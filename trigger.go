@@ -1,24 +1,130 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
 
 // setupTrigger sets up an endpoint for manual triggering of a backup
-func (b *backup) setupTrigger() {
-	if b.TriggerEndpoint == "" {
+func (b *backup) setupTrigger(mux *http.ServeMux) {
+	cfg := b.conf()
+	if cfg.TriggerEndpoint == "" {
 		logger.Info("manual trigger disabled")
 		return
 	}
-	http.Handle(b.TriggerEndpoint, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimSuffix(cfg.TriggerEndpoint, "/")
+	creds := cfg.triggerCredentials()
+	mux.Handle(endpoint, requireAuth(creds, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// ensure HTTP method is POST
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		logger.Info("manual backup triggered")
+		b.handleTrigger(w, r, endpoint)
+	})))
+	mux.Handle(endpoint+"/", requireAuth(creds, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ensure HTTP method is GET
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		run := b.history.get(strings.TrimPrefix(r.URL.Path, endpoint+"/"))
+		if run == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown run"})
+			return
+		}
+		writeJSON(w, http.StatusOK, run.Result())
+	})))
+	logger.Info("manual trigger configured: " + endpoint)
+}
+
+// handleTrigger starts a manual backup and optionally waits for it to complete
+func (b *backup) handleTrigger(w http.ResponseWriter, r *http.Request, endpoint string) {
+	cfg := b.conf()
+	wait, timeout, err := parseWait(r, cfg.TriggerWaitTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	opts, err := parseRunOptions(r)
+	if err == nil {
+		err = cfg.validateRunOptions(&opts)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	run, start, err := b.submit(triggerManual, opts)
+	if err == errOutsideWindow {
+		logger.Warn("manual backup rejected", zap.Error(err))
+		if next, ok := cfg.nextBackupAllowed(time.Now()); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(next).Seconds())+1))
+		}
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Warn("manual backup skipped", zap.Error(err))
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	logger.Info("manual backup triggered", zap.String("run", run.ID()))
+	if start {
 		// trigger a backup
-		go b.Run()
-		// indicate successful trigger attempt
-		w.WriteHeader(http.StatusNoContent)
-	}))
-	logger.Info("manual trigger configured: " + b.TriggerEndpoint)
+		go b.drain(run)
+	}
+
+	w.Header().Set("Location", endpoint+"/"+run.ID())
+	if !wait {
+		writeJSON(w, http.StatusAccepted, run.Result())
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-run.done:
+		result := run.Result()
+		if result.Status == runStatusSucceeded {
+			writeJSON(w, http.StatusOK, result)
+		} else {
+			writeJSON(w, http.StatusInternalServerError, result)
+		}
+	case <-timer.C:
+		// the backup keeps running and can be looked up by its ID
+		writeJSON(w, http.StatusAccepted, run.Result())
+	case <-r.Context().Done():
+	}
+}
+
+// parseWait reads the wait and timeout query parameters of a trigger request
+func parseWait(r *http.Request, defaultTimeout time.Duration) (bool, time.Duration, error) {
+	q := r.URL.Query()
+	wait := false
+	if v := q.Get("wait"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, 0, err
+		}
+		wait = parsed
+	}
+	timeout := defaultTimeout
+	if v := q.Get("timeout"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return false, 0, err
+		}
+		if parsed <= 0 {
+			return false, 0, errors.New("timeout must be positive")
+		}
+		timeout = min(parsed, defaultTimeout)
+	}
+	return wait, timeout, nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseWait(t *testing.T) {
+	tests := []struct {
+		query       string
+		wantWait    bool
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{"", false, time.Hour, false},
+		{"?wait=true", true, time.Hour, false},
+		{"?wait=true&timeout=5m", true, 5 * time.Minute, false},
+		{"?wait=true&timeout=5h", true, time.Hour, false},
+		{"?wait=maybe", false, 0, true},
+		{"?wait=true&timeout=-1s", false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/trigger"+tt.query, nil)
+			wait, timeout, err := parseWait(r, time.Hour)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantWait, wait)
+			assert.Equal(t, tt.wantTimeout, timeout)
+		})
+	}
+}
+
+func Test_triggerConflictAndLookup(t *testing.T) {
+	b := newTestBackup()
+	mux := http.NewServeMux()
+	b.setupTrigger(mux)
+
+	// occupy the backup slot like a running scheduled backup would
+	running, start, err := b.submit(triggerSchedule, runOptions{})
+	require.NoError(t, err)
+	require.True(t, start)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trigger", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/trigger/"+running.ID(), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result runResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, running.ID(), result.ID)
+	assert.Equal(t, runStatusRunning, result.Status)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/trigger/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_triggerQueued(t *testing.T) {
+	b := newTestBackup()
+	b.conf().OverlapPolicy = overlapQueueOne
+	mux := http.NewServeMux()
+	b.setupTrigger(mux)
+
+	_, start, err := b.submit(triggerSchedule, runOptions{})
+	require.NoError(t, err)
+	require.True(t, start)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trigger", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var result runResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, runStatusQueued, result.Status)
+	assert.Equal(t, "/trigger/"+result.ID, w.Header().Get("Location"))
+
+	// only a single run is kept pending
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trigger", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.backupsSkipped))
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.queueLength))
+}
+
+// newTestBackup returns a backup with default settings and unregistered metrics
+func newTestBackup() *backup {
+	b := newBackup(&config{
+		TriggerEndpoint:    "/trigger",
+		TriggerWaitTimeout: time.Hour,
+		OverlapPolicy:      overlapSkip,
+		QueueLimit:         10,
+	})
+	b.initializeMetrics(prometheus.NewRegistry())
+	return b
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// minResticVersion is the oldest restic release whose JSON output is understood,
+// `restic init --json` was added in 0.15.0
+var minResticVersion = [3]int{0, 15, 0}
+
+// maxResticVersion is the newest minor release of restic whose JSON output was checked
+// against the types in restic_types.go
+var maxResticVersion = [3]int{0, 18, 0}
+
+var (
+	// matchResticVersion extracts the version from the output of `restic version`
+	matchResticVersion = regexp.MustCompile(`restic (\d+)\.(\d+)\.(\d+)`)
+	// matchScheme extracts the backend prefix of a repository location
+	matchScheme = regexp.MustCompile(`^([a-z0-9]+):`)
+	// knownSchemes are the repository backends supported by restic
+	knownSchemes = map[string]bool{
+		"local":  true,
+		"sftp":   true,
+		"rest":   true,
+		"s3":     true,
+		"b2":     true,
+		"azure":  true,
+		"gs":     true,
+		"swift":  true,
+		"rclone": true,
+	}
+)
+
+// validationErrors collects all problems found in the configuration
+type validationErrors []string
+
+func (v validationErrors) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(v, "\n  - ")
+}
+
+// add records a problem with a setting
+func (v *validationErrors) add(setting string, err error) {
+	*v = append(*v, setting+": "+err.Error())
+}
+
+// Validate checks the configuration and the environment and reports all problems at once
+func (c *config) Validate() error {
+	var problems validationErrors
+
+	if _, err := scheduleParser.Parse(c.Schedule); err != nil {
+		problems.add("SCHEDULE", err)
+	}
+	if c.CronTZ != "" {
+		if _, err := time.LoadLocation(c.CronTZ); err != nil {
+			problems.add("CRON_TZ", err)
+		}
+	}
+	if c.ScheduleJitter < 0 {
+		problems.add("SCHEDULE_JITTER", errors.New("must not be negative"))
+	}
+	if c.CatchUpWindow < 0 {
+		problems.add("CATCH_UP_WINDOW", errors.New("must not be negative"))
+	}
+	if c.StateFile != "" {
+		if info, err := os.Stat(filepath.Dir(c.StateFile)); err != nil || !info.IsDir() {
+			problems.add("STATE_FILE", errors.Errorf("directory of %q does not exist", c.StateFile))
+		}
+	}
+	if _, err := splitArg(c.Args); err != nil {
+		problems.add("RESTIC_ARGS", err)
+	}
+	for _, hook := range []struct{ setting, command string }{
+		{"PRE_COMMAND", c.PreCommand},
+		{"POST_COMMAND", c.PostCommand},
+		{"ERROR_COMMAND", c.ErrorCommand},
+	} {
+		if err := validateCommand(hook.command); err != nil {
+			problems.add(hook.setting, err)
+		}
+	}
+	if !validSourceType(c.SourceType) {
+		problems.add("SOURCE_TYPE", errors.Errorf("unknown source %q, must be one of %s, %s, %s or %s",
+			c.SourceType, sourcePostgres, sourceMySQL, sourceSQLite, sourceCustom))
+	} else if c.SourceType == sourceCustom {
+		if _, err := splitArg(c.SourceCommand); err != nil {
+			problems.add("SOURCE_COMMAND", err)
+		} else if strings.TrimSpace(c.SourceCommand) == "" {
+			problems.add("SOURCE_COMMAND", errors.Errorf("required for source %q", c.SourceType))
+		} else if err := validateCommand(parseArg(c.SourceCommand)[0]); err != nil {
+			problems.add("SOURCE_COMMAND", err)
+		}
+	} else if c.SourceType != sourceFiles {
+		if c.SourceDatabase == "" {
+			problems.add("SOURCE_DATABASE", errors.Errorf("required for source %q", c.SourceType))
+		}
+		if _, err := splitArg(c.SourceArgs); err != nil {
+			problems.add("SOURCE_ARGS", err)
+		}
+		if err := validateCommand(sourceTools[c.SourceType]); err != nil {
+			problems.add("SOURCE_TYPE", err)
+		}
+	}
+	if c.SourceTimeout < 0 {
+		problems.add("SOURCE_TIMEOUT", errors.New("must not be negative"))
+	}
+	if tools, ok := snapshotTools[c.SnapshotProvider]; !ok && c.SnapshotProvider != snapshotNone {
+		problems.add("SNAPSHOT_PROVIDER", errors.Errorf("unknown provider %q, must be one of %s, %s or %s",
+			c.SnapshotProvider, snapshotBtrfs, snapshotZFS, snapshotLVM))
+	} else if ok {
+		if !filepath.IsAbs(c.SnapshotSource) {
+			problems.add("SNAPSHOT_SOURCE", errors.New("must be an absolute path"))
+		}
+		if c.SnapshotProvider != snapshotBtrfs && c.SnapshotVolume == "" {
+			problems.add("SNAPSHOT_VOLUME", errors.Errorf("required for provider %q", c.SnapshotProvider))
+		}
+		if c.SourceType != sourceFiles {
+			problems.add("SNAPSHOT_PROVIDER", errors.New("cannot be combined with SOURCE_TYPE"))
+		}
+		for _, tool := range tools {
+			if err := validateCommand(tool); err != nil {
+				problems.add("SNAPSHOT_PROVIDER", err)
+			}
+		}
+	}
+	if c.DiscoveryInterval < 0 {
+		problems.add("DOCKER_DISCOVERY_INTERVAL", errors.New("must not be negative"))
+	}
+	if c.DiscoveryInterval > 0 && c.OverlapPolicy != overlapQueueAll {
+		// discovered jobs share the queue, so jobs due at the same time would be skipped
+		problems.add("OVERLAP_POLICY", errors.Errorf("must be %s with DOCKER_DISCOVERY_INTERVAL", overlapQueueAll))
+	}
+	if c.StopContainers || c.DiscoveryInterval > 0 {
+		if err := c.validateDocker(); err != nil {
+			problems.add("DOCKER_HOST", err)
+		}
+	}
+	if err := validateRepository(c.Repository); err != nil {
+		problems.add("RESTIC_REPOSITORY", err)
+	}
+	for _, repo := range c.Secondaries {
+		if err := validateRepository(repo.repository); err != nil {
+			problems.add("SECONDARY_REPOSITORIES", errors.Wrap(err, repo.name))
+		}
+	}
+	switch c.SecondaryMode {
+	case secondaryCopy:
+	case secondaryBackup:
+		if c.SourceType != sourceFiles && len(c.Secondaries) > 0 {
+			problems.add("SECONDARY_MODE", errors.Errorf("%s cannot be combined with SOURCE_TYPE", secondaryBackup))
+		}
+	default:
+		problems.add("SECONDARY_MODE", errors.Errorf("unknown mode %q, must be %s or %s",
+			c.SecondaryMode, secondaryCopy, secondaryBackup))
+	}
+	if !validOverlapPolicy(c.OverlapPolicy) {
+		problems.add("OVERLAP_POLICY", errors.Errorf("unknown policy %q, must be one of %s, %s or %s",
+			c.OverlapPolicy, overlapSkip, overlapQueueOne, overlapQueueAll))
+	}
+	if c.OverlapPolicy == overlapQueueAll && c.QueueLimit < 1 {
+		problems.add("QUEUE_LIMIT", errors.New("must be at least 1"))
+	}
+	if len(c.BackupWindows) > 0 || len(c.BlackoutPeriods) > 0 {
+		if _, ok := c.nextBackupAllowed(time.Now()); !ok {
+			problems.add("BACKUP_WINDOWS", errors.New("backups are never allowed in combination with BLACKOUT_PERIODS"))
+		}
+	}
+	if c.LimitUpload < 0 {
+		problems.add("LIMIT_UPLOAD", errors.New("must not be negative"))
+	}
+	if c.LimitDownload < 0 {
+		problems.add("LIMIT_DOWNLOAD", errors.New("must not be negative"))
+	}
+	if _, err := parseNice(strconv.Itoa(c.Nice)); err != nil {
+		problems.add("NICE", err)
+	}
+	for _, name := range c.priorityCommands() {
+		if err := validateCommand(name); err != nil {
+			problems.add(strings.ToUpper(name), err)
+		}
+	}
+	if c.TriggerWaitTimeout <= 0 {
+		problems.add("TRIGGER_WAIT_TIMEOUT", errors.New("must be positive"))
+	}
+	for _, path := range c.TriggerAllowedPaths {
+		if !filepath.IsAbs(path) {
+			problems.add("TRIGGER_ALLOWED_PATHS", errors.Errorf("%q is not absolute", path))
+		}
+	}
+	if _, err := c.tlsConfig(); err != nil {
+		problems.add("TLS", err)
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// validateCommand checks that a hook command can be executed
+func validateCommand(command string) error {
+	trimmed := strings.TrimSpace(command)
+	if trimmed == "" {
+		return nil
+	}
+	name := strings.Split(trimmed, " ")[0]
+	if _, err := exec.LookPath(name); err != nil {
+		return errors.Errorf("executable %q not found", name)
+	}
+	return nil
+}
+
+// validateRepository checks that the repository location uses a backend known to restic
+func validateRepository(repository string) error {
+	match := matchScheme.FindStringSubmatch(repository)
+	if match == nil || len(match[1]) == 1 {
+		// a plain path to a local repository, possibly with a Windows drive letter
+		return nil
+	}
+	if !knownSchemes[match[1]] {
+		return errors.Errorf("unknown backend %q", match[1])
+	}
+	if strings.TrimPrefix(repository, match[0]) == "" {
+		return errors.Errorf("missing location for backend %q", match[1])
+	}
+	return nil
+}
+
+// readResticVersion checks that restic is available and recent enough, and returns its version
+func readResticVersion(binary string) ([3]int, error) {
+	var version [3]int
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return version, errors.Errorf("executable %q not found", binary)
+	}
+	out, err := exec.Command(path, "version", "--json").Output()
+	if err != nil {
+		// in case a release rejects --json for this command
+		out, err = exec.Command(path, "version").Output()
+	}
+	if err != nil {
+		return version, errors.Wrap(err, "determining version")
+	}
+	if version, err = parseResticVersion(out); err != nil {
+		return version, err
+	}
+	if compareVersions(version, minResticVersion) < 0 {
+		return version, errors.Errorf("version %s does not support --json, at least %s is required",
+			formatVersion(version), formatVersion(minResticVersion))
+	}
+	return version, nil
+}
+
+// parseResticVersion reads the version from the output of `restic version --json`, or from
+// the text printed by releases which ignore --json for this command
+func parseResticVersion(out []byte) ([3]int, error) {
+	var version [3]int
+	text := string(out)
+	var msg VersionMessage
+	if err := json.Unmarshal(out, &msg); err == nil && msg.Version != "" {
+		text = "restic " + msg.Version
+	}
+	match := matchResticVersion.FindStringSubmatch(text)
+	if match == nil {
+		return version, errors.Errorf("unexpected version output %q", strings.TrimSpace(string(out)))
+	}
+	for i := range version {
+		version[i], _ = strconv.Atoi(match[i+1])
+	}
+	return version, nil
+}
+
+// validateStartup validates the configuration and the restic binary, which is only checked
+// once since RESTIC_BINARY requires a restart, and returns the version of restic
+func validateStartup(cfg *config) ([3]int, error) {
+	problems, _ := cfg.Validate().(validationErrors)
+	version, err := readResticVersion(cfg.ResticBinary)
+	if err != nil {
+		problems.add("restic", err)
+	}
+	if len(problems) > 0 {
+		return version, problems
+	}
+	return version, nil
+}
+
+// logResticVersion logs the version of restic found at startup, warning about releases whose
+// JSON output may have changed
+func logResticVersion(binary string, version [3]int) string {
+	// patch releases don't change the output
+	if compareVersions([3]int{version[0], version[1], 0}, maxResticVersion) > 0 {
+		logger.Warn("restic is newer than the releases known to work, its output may not be understood",
+			zap.String("version", formatVersion(version)),
+			zap.String("newest known", formatVersion(maxResticVersion)))
+	}
+	logger.Info("using restic", zap.String("binary", binary), zap.String("version", formatVersion(version)))
+	return formatVersion(version)
+}
+
+// compareVersions returns -1, 0 or 1 if a is older than, equal to or newer than b
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// formatVersion renders a version as major.minor.patch
+func formatVersion(v [3]int) string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxWindowSearch bounds the search for the next time a backup is allowed
+const maxWindowSearch = 8 * 24 * time.Hour
+
+// errOutsideWindow is returned when a run is skipped because of BACKUP_WINDOWS or BLACKOUT_PERIODS
+var errOutsideWindow = errors.New("backups are not allowed at this time")
+
+// weekdays maps abbreviated day names to weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is a recurring period of time such as "Mon-Fri 09:00-18:00"
+type timeWindow struct {
+	// spec is the window as configured
+	spec string
+	// days on which the window opens, indexed by weekday
+	days [7]bool
+	// start and end are offsets from midnight, the window spans midnight if end <= start
+	start time.Duration
+	end   time.Duration
+}
+
+// parseWindow parses a window of the form "[days] HH:MM-HH:MM", where days is a comma-separated
+// list of day names or ranges like "Mon-Fri,Sun". Without days, the window applies every day.
+func parseWindow(spec string) (timeWindow, error) {
+	w := timeWindow{spec: strings.TrimSpace(spec)}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, errors.Errorf("invalid window %q", spec)
+	}
+	if len(fields) == 2 {
+		if err := w.parseDays(fields[0]); err != nil {
+			return w, errors.Wrapf(err, "invalid window %q", spec)
+		}
+	} else {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return w, errors.Errorf("invalid window %q: missing time range", spec)
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(from); err != nil {
+		return w, errors.Wrapf(err, "invalid window %q", spec)
+	}
+	if w.end, err = parseTimeOfDay(to); err != nil {
+		return w, errors.Wrapf(err, "invalid window %q", spec)
+	}
+	if w.start == w.end {
+		return w, errors.Errorf("invalid window %q: empty time range", spec)
+	}
+	return w, nil
+}
+
+// parseDays parses a comma-separated list of days and day ranges
+func (w *timeWindow) parseDays(spec string) error {
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return errors.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return errors.Errorf("unknown day %q", to)
+			}
+		}
+		// ranges may wrap around the end of the week, e.g. Sat-Mon
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimeOfDay parses HH:MM into an offset from midnight, allowing 24:00
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String returns the window as configured
+func (w timeWindow) String() string {
+	return w.spec
+}
+
+// contains returns true if the time lies within the window
+func (w timeWindow) contains(t time.Time) bool {
+	// the wall clock time, which differs from the time since midnight on DST transitions
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start < w.end {
+		return w.days[t.Weekday()] && offset >= w.start && offset < w.end
+	}
+	// the window opens on one day and closes on the next
+	yesterday := (t.Weekday() + 6) % 7
+	return w.days[t.Weekday()] && offset >= w.start || w.days[yesterday] && offset < w.end
+}
+
+// windowList is a semicolon-separated list of windows read from the environment
+type windowList []timeWindow
+
+// Decode implements envconfig.Decoder
+func (l *windowList) Decode(value string) error {
+	*l = nil
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		w, err := parseWindow(spec)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, w)
+	}
+	return nil
+}
+
+// String returns the windows as configured
+func (l windowList) String() string {
+	specs := make([]string, len(l))
+	for i, w := range l {
+		specs[i] = w.spec
+	}
+	return strings.Join(specs, "; ")
+}
+
+// contains returns true if the time lies within any of the windows
+func (l windowList) contains(t time.Time) bool {
+	for _, w := range l {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// location returns the time zone windows are evaluated in, which is the one of the schedule
+func (c *config) location() *time.Location {
+	if c.CronTZ != "" {
+		if loc, err := time.LoadLocation(c.CronTZ); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// backupAllowed returns true if backups may run at the given time
+func (c *config) backupAllowed(t time.Time) bool {
+	return c.allowedAt(t.In(c.location()))
+}
+
+// allowedAt checks the windows and blackout periods against a time in the configured time zone
+func (c *config) allowedAt(t time.Time) bool {
+	if len(c.BackupWindows) > 0 && !c.BackupWindows.contains(t) {
+		return false
+	}
+	return !c.BlackoutPeriods.contains(t)
+}
+
+// nextBackupAllowed returns the next full minute at which backups may run, or false if
+// there is none within the next week
+func (c *config) nextBackupAllowed(t time.Time) (time.Time, bool) {
+	t = t.In(c.location())
+	end := t.Add(maxWindowSearch)
+	for next := t.Truncate(time.Minute).Add(time.Minute); next.Before(end); next = next.Add(time.Minute) {
+		if c.allowedAt(next) {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// deferRun holds back a manually triggered run until backups are allowed again
+func (b *backup) deferRun(r *run, at time.Time) {
+	r.setDeferred(at)
+	b.backupsDeferred.Inc()
+	logger.Info("backup deferred", zap.String("run", r.ID()), zap.Time("until", at))
+	time.AfterFunc(time.Until(at), func() {
+		b.resumeRun(r)
+	})
+}
+
+// resumeRun hands a deferred run to the queue once backups are allowed
+func (b *backup) resumeRun(r *run) {
+	cfg := b.conf()
+	now := time.Now()
+	if !cfg.backupAllowed(now) {
+		// the windows may have been changed by a reload in the meantime
+		if next, ok := cfg.nextBackupAllowed(now); ok {
+			b.deferRun(r, next)
+			return
+		}
+		b.backupsSkipped.Inc()
+		r.finish(errOutsideWindow, nil)
+		return
+	}
+	start, err := b.enqueue(r)
+	if err != nil {
+		logger.Warn("deferred backup skipped", zap.String("run", r.ID()), zap.Error(err))
+		r.finish(err, nil)
+		return
+	}
+	if start {
+		b.drain(r)
+	}
+}
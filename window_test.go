@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseWindow(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"09:00-18:00", false},
+		{"Mon-Fri 09:00-18:00", false},
+		{"sat,sun 00:00-24:00", false},
+		{"Fri-Mon 22:00-06:00", false},
+		{"Mon-Fri", true},
+		{"Mon-Fri 09:00", true},
+		{"Someday 09:00-18:00", true},
+		{"Mon-Fri 09:00-25:00", true},
+		{"09:00-09:00", true},
+		{"Mon 09:00-10:00 extra", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			w, err := parseWindow(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.spec, w.String())
+		})
+	}
+}
+
+func Test_timeWindow_contains(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		time time.Time
+		want bool
+	}{
+		{"Mon-Fri 09:00-18:00", at(1, 9, 0), true},
+		{"Mon-Fri 09:00-18:00", at(5, 17, 59), true},
+		{"Mon-Fri 09:00-18:00", at(1, 18, 0), false},
+		{"Mon-Fri 09:00-18:00", at(6, 12, 0), false},
+		{"22:00-06:00", at(3, 23, 0), true},
+		{"22:00-06:00", at(3, 5, 59), true},
+		{"22:00-06:00", at(3, 12, 0), false},
+		// the night from Friday to Saturday still belongs to Friday
+		{"Mon-Fri 22:00-06:00", at(6, 3, 0), true},
+		{"Mon-Fri 22:00-06:00", at(1, 3, 0), false},
+		{"Sat-Mon 00:00-24:00", at(7, 12, 0), true},
+		{"Sat-Mon 00:00-24:00", at(1, 23, 59), true},
+		{"Sat-Mon 00:00-24:00", at(2, 0, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec+" "+tt.time.Format("Mon 15:04"), func(t *testing.T) {
+			w, err := parseWindow(tt.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, w.contains(tt.time))
+		})
+	}
+}
+
+func Test_timeWindow_containsDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	w, err := parseWindow("09:30-18:00")
+	require.NoError(t, err)
+	// clocks skip from 02:00 to 03:00 on 2024-03-31 and go back from 03:00 to 02:00 on 2024-10-27
+	for _, day := range []time.Time{
+		time.Date(2024, time.March, 31, 0, 0, 0, 0, berlin),
+		time.Date(2024, time.October, 27, 0, 0, 0, 0, berlin),
+	} {
+		at := func(hour, minute int) time.Time {
+			return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, berlin)
+		}
+		assert.True(t, w.contains(at(9, 45)))
+		assert.False(t, w.contains(at(9, 15)))
+		assert.False(t, w.contains(at(18, 15)))
+	}
+}
+
+func Test_nextBackupAllowed(t *testing.T) {
+	cfg := &config{CronTZ: "UTC"}
+	require.NoError(t, cfg.BlackoutPeriods.Decode("Mon-Fri 09:00-18:00"))
+
+	monday := time.Date(2024, 1, 1, 10, 30, 15, 0, time.UTC)
+	assert.False(t, cfg.backupAllowed(monday))
+	next, ok := cfg.nextBackupAllowed(monday)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC), next.UTC())
+
+	friday := time.Date(2024, 1, 5, 20, 0, 0, 0, time.UTC)
+	assert.True(t, cfg.backupAllowed(friday))
+
+	// windows restrict backups further
+	require.NoError(t, cfg.BackupWindows.Decode("Sat,Sun 00:00-24:00"))
+	next, ok = cfg.nextBackupAllowed(friday)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC), next.UTC())
+
+	require.NoError(t, cfg.BlackoutPeriods.Decode("00:00-24:00"))
+	_, ok = cfg.nextBackupAllowed(friday)
+	assert.False(t, ok)
+}
+
+// blackoutNow returns a blackout period covering the current time
+func blackoutNow(t *testing.T) windowList {
+	now := time.Now()
+	spec := now.Add(-time.Minute).Format("15:04") + "-" + now.Add(2*time.Minute).Format("15:04")
+	var l windowList
+	require.NoError(t, l.Decode(spec))
+	return l
+}
+
+func Test_submitOutsideWindow(t *testing.T) {
+	b := newTestBackup()
+	b.conf().BlackoutPeriods = blackoutNow(t)
+
+	_, _, err := b.submit(triggerSchedule, runOptions{})
+	assert.Equal(t, errOutsideWindow, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.backupsSkipped))
+
+	mux := http.NewServeMux()
+	b.setupTrigger(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trigger", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+func Test_triggerDeferred(t *testing.T) {
+	b := newTestBackup()
+	b.conf().BlackoutPeriods = blackoutNow(t)
+	b.conf().DeferTriggers = true
+	mux := http.NewServeMux()
+	b.setupTrigger(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/trigger", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var result runResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, runStatusDeferred, result.Status)
+	require.NotNil(t, result.DeferredUntil)
+	assert.True(t, result.DeferredUntil.After(time.Now()))
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.backupsDeferred))
+
+	// scheduled runs are never deferred
+	_, _, err := b.submit(triggerSchedule, runOptions{})
+	assert.Equal(t, errOutsideWindow, err)
+}